@@ -1,12 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
+	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type User struct {
@@ -16,15 +22,118 @@ type User struct {
 	Age       int    `gorm:"check:age>0"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
+	DeletedAt gorm.DeletedAt `gorm:"index"`
+}
+
+// Returned when no user matches a lookup
+var ErrUserNotFound = errors.New("user not found")
+
+// Assembles the Postgres DSN from DB_* variables read through getenv.
+// DB_USER and DB_NAME are required, everything else has a default.
+func BuildDSN(getenv func(string) string) (string, error) {
+	get := func(key, fallback string) string {
+		if value := getenv(key); value != "" {
+			return value
+		}
+		return fallback
+	}
+
+	user := getenv("DB_USER")
+	if user == "" {
+		return "", errors.New("DB_USER environment variable is required")
+	}
+	name := getenv("DB_NAME")
+	if name == "" {
+		return "", errors.New("DB_NAME environment variable is required")
+	}
+
+	dsn := fmt.Sprintf("host=%s user=%s dbname=%s port=%s sslmode=%s TimeZone=UTC",
+		quoteDSNValue(get("DB_HOST", "localhost")), quoteDSNValue(user), quoteDSNValue(name),
+		quoteDSNValue(get("DB_PORT", "5432")), quoteDSNValue(get("DB_SSLMODE", "disable")))
+	if password := getenv("DB_PASSWORD"); password != "" {
+		dsn += " password=" + quoteDSNValue(password)
+	}
+	return dsn, nil
+}
+
+// Escapes backslashes and single quotes, the two characters special inside a
+// quoted libpq keyword value
+var dsnEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`)
+
+// Quotes a DSN value so spaces, quotes or "=" in it can't break the string
+// apart or add keywords of their own
+func quoteDSNValue(value string) string {
+	return "'" + dsnEscaper.Replace(value) + "'"
+}
+
+// Settings for the connection pool behind a *gorm.DB
+type PoolConfig struct {
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+}
+
+// Reads DB_MAX_OPEN_CONNS, DB_MAX_IDLE_CONNS and DB_CONN_MAX_LIFETIME through getenv,
+// falling back to defaults for any that are unset
+func PoolConfigFromEnv(getenv func(string) string) (PoolConfig, error) {
+	cfg := PoolConfig{
+		MaxOpenConns:    25,
+		MaxIdleConns:    5,
+		ConnMaxLifetime: 30 * time.Minute,
+	}
+	if value := getenv("DB_MAX_OPEN_CONNS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_MAX_OPEN_CONNS: %w", err)
+		}
+		cfg.MaxOpenConns = n
+	}
+	if value := getenv("DB_MAX_IDLE_CONNS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_MAX_IDLE_CONNS: %w", err)
+		}
+		cfg.MaxIdleConns = n
+	}
+	if value := getenv("DB_CONN_MAX_LIFETIME"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DB_CONN_MAX_LIFETIME: %w", err)
+		}
+		cfg.ConnMaxLifetime = d
+	}
+	return cfg, nil
+}
+
+// Applies the pool settings to the sql.DB underlying db
+func ConfigurePool(db *gorm.DB, cfg PoolConfig) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	sqlDB.SetMaxOpenConns(cfg.MaxOpenConns)
+	sqlDB.SetMaxIdleConns(cfg.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+	return nil
 }
 
 func ConnectDB() (*gorm.DB, error) {
-	dsn := "host=localhost user=bipl dbname=gorm_demo port=5432 sslmode=disable TimeZone=UTC"
+	dsn, err := BuildDSN(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	pool, err := PoolConfigFromEnv(os.Getenv)
+	if err != nil {
+		return nil, err
+	}
 	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
 	if err != nil {
 		fmt.Println("An error occured while connecting to Postgres")
 		return nil, err
 	}
+	if err := ConfigurePool(db, pool); err != nil {
+		return nil, err
+	}
 	// Auto-migrate the user schema
 	if err := db.AutoMigrate(&User{}); err != nil {
 		return nil, err
@@ -32,44 +141,218 @@ func ConnectDB() (*gorm.DB, error) {
 	return db, nil
 }
 
+// Calls open until it succeeds or attempts run out, doubling the wait after each failure.
+// The last error is returned when every attempt fails.
+func ConnectWithRetry(open func() (*gorm.DB, error), attempts int, backoff time.Duration) (*gorm.DB, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var db *gorm.DB
+		if db, err = open(); err == nil {
+			return db, nil
+		}
+		if attempt == attempts {
+			break
+		}
+		log.Printf("Connecting to database failed (attempt %d/%d): %v, retrying in %s", attempt, attempts, err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", attempts, err)
+}
+
+// Connects to the database, retrying while it is not ready yet
+func ConnectDBWithRetry(attempts int, backoff time.Duration) (*gorm.DB, error) {
+	return ConnectWithRetry(ConnectDB, attempts, backoff)
+}
+
+// Checks that the database is actually reachable, for use by readiness probes
+func PingDB(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	return sqlDB.PingContext(ctx)
+}
+
 // Create a new user in the database
-func CreateUser(db *gorm.DB, user *User) error {
-	return db.Create(user).Error
+func CreateUser(ctx context.Context, db *gorm.DB, user *User) error {
+	return db.WithContext(ctx).Create(user).Error
+}
+
+// Number of rows inserted per statement by CreateUsers
+const createBatchSize = 100
+
+// Creates all users in a single transaction, if any insert fails none of them are kept
+func CreateUsers(ctx context.Context, db *gorm.DB, users []*User) error {
+	return db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return tx.CreateInBatches(users, createBatchSize).Error
+	})
+}
+
+// Inserts the user, or updates the name, age and updated_at of the existing user with the
+// same email. A soft-deleted user with that email is restored, since the unique email
+// would otherwise keep it from ever being created again. user is filled in with the
+// resulting row.
+func UpsertUser(ctx context.Context, db *gorm.DB, user *User) error {
+	return db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "email"}},
+		DoUpdates: clause.AssignmentColumns([]string{"name", "age", "updated_at", "deleted_at"}),
+	}, clause.Returning{}).Create(user).Error
 }
 
 // Retrieves the user with the specified id
-func GetUserByID(db *gorm.DB, id uint) (*User, error) {
+func GetUserByID(ctx context.Context, db *gorm.DB, id uint) (*User, error) {
 	var user User
-	if err := db.First(&user, id).Error; err != nil {
+	if err := db.WithContext(ctx).First(&user, id).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
 		return nil, err
 	}
 	return &user, nil
 }
 
-// Retrieves all users in the database
-func GetAllUsers(db *gorm.DB) ([]User, error) {
+// Retrieves the user with the specified email, ignoring case
+func GetUserByEmail(ctx context.Context, db *gorm.DB, email string) (*User, error) {
+	var user User
+	if err := db.WithContext(ctx).Where("LOWER(email) = LOWER(?)", email).First(&user).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUserNotFound
+		}
+		return nil, err
+	}
+	return &user, nil
+}
+
+// Escapes the LIKE wildcards in term so it only matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Finds up to limit users whose name contains term, ignoring case. limit must
+// be positive and is capped at maxUsersPageSize.
+func SearchUsersByName(ctx context.Context, db *gorm.DB, term string, limit int) ([]User, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	limit = min(limit, maxUsersPageSize)
+
+	var users []User
+	pattern := "%" + likeEscaper.Replace(term) + "%"
+	err := db.WithContext(ctx).
+		Where(`name ILIKE ? ESCAPE '\'`, pattern).
+		Order("name").
+		Limit(limit).
+		Find(&users).Error
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Columns GetAllUsers is allowed to order by
+var userOrderColumns = map[string]bool{
+	"id":         true,
+	"name":       true,
+	"email":      true,
+	"age":        true,
+	"created_at": true,
+	"updated_at": true,
+}
+
+// Most users returned by a single GetAllUsers call
+const maxUsersPageSize = 100
+
+// Retrieves a page of users ordered by orderBy, prefix the column with "-" for
+// descending order. An empty orderBy sorts by id. limit must be positive and is
+// capped at maxUsersPageSize.
+func GetAllUsers(ctx context.Context, db *gorm.DB, limit, offset int, orderBy string) ([]User, error) {
+	// GORM drops a negative limit or offset from the query, which would load the whole table
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative, got %d", offset)
+	}
+	limit = min(limit, maxUsersPageSize)
+
+	if orderBy == "" {
+		orderBy = "id"
+	}
+	desc := strings.HasPrefix(orderBy, "-")
+	column := strings.TrimPrefix(orderBy, "-")
+	if !userOrderColumns[column] {
+		return nil, fmt.Errorf("cannot order users by %q", column)
+	}
+
 	var users []User
-	if err := db.Find(&users).Error; err != nil {
+	err := db.WithContext(ctx).
+		Order(clause.OrderByColumn{Column: clause.Column{Name: column}, Desc: desc}).
+		Limit(limit).
+		Offset(offset).
+		Find(&users).Error
+	if err != nil {
 		return nil, err
 	}
 	return users, nil
 }
 
+// Counts the users in the database
+func CountUsers(ctx context.Context, db *gorm.DB) (int64, error) {
+	var count int64
+	if err := db.WithContext(ctx).Model(&User{}).Count(&count).Error; err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+// Reports whether a user with the given email exists without loading the row.
+// Case is ignored, like GetUserByEmail does.
+func UserExistsByEmail(ctx context.Context, db *gorm.DB, email string) (bool, error) {
+	var found []int
+	err := db.WithContext(ctx).Model(&User{}).
+		Select("1").
+		Where("LOWER(email) = LOWER(?)", email).
+		Limit(1).
+		Find(&found).Error
+	if err != nil {
+		return false, err
+	}
+	return len(found) > 0, nil
+}
+
 // Updates an existing user's information
-func UpdateUser(db *gorm.DB, user *User) error {
-	return db.Save(user).Error
+func UpdateUser(ctx context.Context, db *gorm.DB, user *User) error {
+	return db.WithContext(ctx).Save(user).Error
+}
+
+// Soft deletes the user with the specified id, the row stays in the table with DeletedAt set
+func DeleteUser(ctx context.Context, db *gorm.DB, id uint) error {
+	return db.WithContext(ctx).Delete(&User{}, id).Error
+}
+
+// Retrieves all users, including the soft deleted ones
+func GetAllUsersIncludingDeleted(ctx context.Context, db *gorm.DB) ([]User, error) {
+	var users []User
+	if err := db.WithContext(ctx).Unscoped().Find(&users).Error; err != nil {
+		return nil, err
+	}
+	return users, nil
 }
 
-func DeleteUser(db *gorm.DB, id uint) error {
-	return db.Delete(&User{}, id).Error
+// Removes the user with the specified id from the table for good
+func PermanentlyDeleteUser(ctx context.Context, db *gorm.DB, id uint) error {
+	return db.WithContext(ctx).Unscoped().Delete(&User{}, id).Error
 }
 
 func main() {
 	// Performing CRUD operations
-	db, err := ConnectDB()
+	db, err := ConnectDBWithRetry(5, time.Second)
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
+	ctx := context.Background()
 
 	user := &User{
 		Name:  "Jack",
@@ -77,20 +360,20 @@ func main() {
 		Age:   50,
 	}
 	// Creating user
-	if err := CreateUser(db, user); err != nil {
+	if err := CreateUser(ctx, db, user); err != nil {
 		log.Fatalf("An error occured while creating new user : %v", err)
 	}
 	fmt.Printf("Created user: %+v\n", *user)
 
 	// Fetching user
-	fetchedUser, err := GetUserByID(db, user.ID)
+	fetchedUser, err := GetUserByID(ctx, db, user.ID)
 	if err != nil {
 		log.Fatalf("Failed to fetch user data: %+v\n", err)
 	}
 	fmt.Println("Fetched user details:", *fetchedUser)
 
 	// Fetching all users
-	all_users, err := GetAllUsers(db)
+	all_users, err := GetAllUsers(ctx, db, 10, 0, "-created_at")
 	if err != nil {
 		log.Fatalf("Failed to fetch user information: %+v\n", err)
 	}
@@ -98,13 +381,13 @@ func main() {
 
 	// Updating user information
 	fetchedUser.Email = "lord.commander@gmail.com"
-	if err := UpdateUser(db, fetchedUser); err != nil {
+	if err := UpdateUser(ctx, db, fetchedUser); err != nil {
 		log.Fatalf("Failed to update user: %v", err)
 	}
 	fmt.Println("Updated user age to : ", fetchedUser.Email)
 
 	// Deleting user information
-	if err := DeleteUser(db, user.ID); err != nil {
+	if err := DeleteUser(ctx, db, user.ID); err != nil {
 		log.Fatalf("Failed to delete user data")
 	}
 	fmt.Println("User deleted successfully")
@@ -0,0 +1,742 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Helper function opening a handle to a server that isn't there. database/sql only
+// dials on first use, so tests that never reach the server can run without Postgres.
+func openUnreachableDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{
+		DisableAutomaticPing: true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeOnCleanup(t, db)
+	return db
+}
+
+// Helper function returning a dry run session on an unreachable database, along with
+// the SQL of every query it was asked to run
+func dryRunDB(t *testing.T) (*gorm.DB, *[]string) {
+	t.Helper()
+	db := openUnreachableDB(t).Session(&gorm.Session{DryRun: true})
+	var queries []string
+	err := db.Callback().Query().After("gorm:query").Register("test:record", func(tx *gorm.DB) {
+		queries = append(queries, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, &queries
+}
+
+// Schema the database tests create their tables in. go test runs packages in
+// parallel and gorm_associations has a users table of its own, so each package
+// keeps to its own schema.
+const testSchema = "gorm_test"
+
+// Helper function connecting to the Postgres database in TEST_DATABASE_DSN, skipping
+// the test when it isn't set. The users table is emptied so every test starts clean.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RuntimeParams["search_path"] = testSchema
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: stdlib.OpenDB(*config)}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	closeOnCleanup(t, db)
+	if err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + testSchema).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("TRUNCATE users RESTART IDENTITY").Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Helper function closing the connections of db when the test ends
+func closeOnCleanup(t *testing.T, db *gorm.DB) {
+	t.Helper()
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+}
+
+func TestCancelledContext(t *testing.T) {
+	db := openUnreachableDB(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		name string
+		run  func() error
+	}{
+		{"CreateUser", func() error {
+			return CreateUser(ctx, db, &User{Name: "Jack", Email: "jack@example.com", Age: 50})
+		}},
+		{"GetUserByID", func() error {
+			_, err := GetUserByID(ctx, db, 1)
+			return err
+		}},
+		{"GetAllUsers", func() error {
+			_, err := GetAllUsers(ctx, db, 10, 0, "")
+			return err
+		}},
+		{"UpdateUser", func() error {
+			return UpdateUser(ctx, db, &User{ID: 1, Name: "Jack", Email: "jack@example.com", Age: 51})
+		}},
+		{"DeleteUser", func() error {
+			return DeleteUser(ctx, db, 1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.run(); !errors.Is(err, context.Canceled) {
+				t.Fatalf("err = %v, want %v", err, context.Canceled)
+			}
+		})
+	}
+}
+
+// Helper function serving env as a getenv function
+func fakeEnv(env map[string]string) func(string) string {
+	return func(key string) string { return env[key] }
+}
+
+func TestBuildDSN(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    string
+		wantErr string
+	}{
+		{
+			name: "all variables set",
+			env: map[string]string{
+				"DB_HOST": "db.internal", "DB_USER": "app", "DB_PASSWORD": "secret",
+				"DB_NAME": "users", "DB_PORT": "6432", "DB_SSLMODE": "require",
+			},
+			want: "host='db.internal' user='app' dbname='users' port='6432' sslmode='require' TimeZone=UTC password='secret'",
+		},
+		{
+			name: "defaults",
+			env:  map[string]string{"DB_USER": "app", "DB_NAME": "users"},
+			want: "host='localhost' user='app' dbname='users' port='5432' sslmode='disable' TimeZone=UTC",
+		},
+		{
+			name: "special characters are quoted",
+			env:  map[string]string{"DB_USER": "app", "DB_NAME": "users", "DB_PASSWORD": `p@ss word=1 'q' \`},
+			want: `host='localhost' user='app' dbname='users' port='5432' sslmode='disable' TimeZone=UTC password='p@ss word=1 \'q\' \\'`,
+		},
+		{
+			name:    "missing user",
+			env:     map[string]string{"DB_NAME": "users"},
+			wantErr: "DB_USER environment variable is required",
+		},
+		{
+			name:    "missing name",
+			env:     map[string]string{"DB_USER": "app"},
+			wantErr: "DB_NAME environment variable is required",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := BuildDSN(fakeEnv(tt.env))
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("dsn = %q\nwant  %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Helper function inserting users with the given names, aged 21 and up in order
+func seedUsers(t *testing.T, db *gorm.DB, names ...string) []User {
+	t.Helper()
+	users := make([]User, len(names))
+	for i, name := range names {
+		users[i] = User{Name: name, Email: strings.ToLower(name) + "@example.com", Age: 21 + i}
+		if err := CreateUser(context.Background(), db, &users[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return users
+}
+
+// Helper function listing the names of users in order
+func userNames(users []User) []string {
+	names := make([]string, len(users))
+	for i, user := range users {
+		names[i] = user.Name
+	}
+	return names
+}
+
+func TestGetAllUsersQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		limit   int
+		offset  int
+		orderBy string
+		want    string
+		wantErr bool
+	}{
+		{"default order", 10, 0, "", `SELECT * FROM "users" WHERE "users"."deleted_at" IS NULL ORDER BY "id" LIMIT 10`, false},
+		{"descending", 10, 20, "-age", `SELECT * FROM "users" WHERE "users"."deleted_at" IS NULL ORDER BY "age" DESC LIMIT 10 OFFSET 20`, false},
+		{"limit is capped", 1000, 0, "name", `SELECT * FROM "users" WHERE "users"."deleted_at" IS NULL ORDER BY "name" LIMIT 100`, false},
+		{"unknown column", 10, 0, "password", "", true},
+		{"injection", 10, 0, "name; DROP TABLE users", "", true},
+		{"zero limit", 0, 0, "", "", true},
+		{"negative limit", -1, 0, "", "", true},
+		{"negative offset", 10, -1, "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, queries := dryRunDB(t)
+
+			_, err := GetAllUsers(context.Background(), db, tt.limit, tt.offset, tt.orderBy)
+			if tt.wantErr {
+				if err == nil || len(*queries) != 0 {
+					t.Fatalf("err = %v, queries = %q, want an error before any query", err, *queries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*queries) != 1 || (*queries)[0] != tt.want {
+				t.Fatalf("queries = %q, want %q", *queries, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAllUsersPages(t *testing.T) {
+	db := openTestDB(t)
+	seedUsers(t, db, "Alice", "Bob", "Carol", "Dave", "Erin")
+	ctx := context.Background()
+
+	tests := []struct {
+		name    string
+		limit   int
+		offset  int
+		orderBy string
+		want    []string
+	}{
+		{"first page", 2, 0, "name", []string{"Alice", "Bob"}},
+		{"middle page", 2, 2, "name", []string{"Carol", "Dave"}},
+		{"last page", 2, 4, "name", []string{"Erin"}},
+		{"past the end", 2, 10, "name", []string{}},
+		{"descending age", 3, 0, "-age", []string{"Erin", "Dave", "Carol"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := GetAllUsers(ctx, db, tt.limit, tt.offset, tt.orderBy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := userNames(users); !slices.Equal(got, tt.want) {
+				t.Fatalf("names = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSoftDeleteUser(t *testing.T) {
+	db := openTestDB(t)
+	users := seedUsers(t, db, "Alice", "Bob")
+	ctx := context.Background()
+
+	if err := DeleteUser(ctx, db, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	visible, err := GetAllUsers(ctx, db, 10, 0, "name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := userNames(visible); !slices.Equal(got, []string{"Bob"}) {
+		t.Fatalf("GetAllUsers names = %q, want only Bob", got)
+	}
+	if _, err := GetUserByID(ctx, db, users[0].ID); !errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("GetUserByID of a deleted user: err = %v, want %v", err, ErrUserNotFound)
+	}
+
+	all, err := GetAllUsersIncludingDeleted(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("GetAllUsersIncludingDeleted returned %d users, want 2", len(all))
+	}
+	for _, user := range all {
+		if deleted := user.DeletedAt.Valid; deleted != (user.ID == users[0].ID) {
+			t.Fatalf("user %s has DeletedAt set = %v", user.Name, deleted)
+		}
+	}
+
+	if err := PermanentlyDeleteUser(ctx, db, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	all, err = GetAllUsersIncludingDeleted(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := userNames(all); !slices.Equal(got, []string{"Bob"}) {
+		t.Fatalf("names after permanent delete = %q, want only Bob", got)
+	}
+}
+
+func TestCreateUsers(t *testing.T) {
+	tests := []struct {
+		name      string
+		batch     []*User
+		wantErr   bool
+		wantNames []string
+	}{
+		{
+			name: "all new",
+			batch: []*User{
+				{Name: "Bob", Email: "bob@example.com", Age: 30},
+				{Name: "Carol", Email: "carol@example.com", Age: 31},
+			},
+			wantNames: []string{"Alice", "Bob", "Carol"},
+		},
+		{
+			name: "duplicate within the batch",
+			batch: []*User{
+				{Name: "Bob", Email: "bob@example.com", Age: 30},
+				{Name: "Bobby", Email: "bob@example.com", Age: 31},
+			},
+			wantErr:   true,
+			wantNames: []string{"Alice"},
+		},
+		{
+			name: "duplicate of a stored user",
+			batch: []*User{
+				{Name: "Bob", Email: "bob@example.com", Age: 30},
+				{Name: "Alice Again", Email: "alice@example.com", Age: 31},
+			},
+			wantErr:   true,
+			wantNames: []string{"Alice"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := openTestDB(t)
+			seedUsers(t, db, "Alice")
+			ctx := context.Background()
+
+			err := CreateUsers(ctx, db, tt.batch)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tt.wantErr)
+			}
+			stored, err := GetAllUsers(ctx, db, 10, 0, "name")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := userNames(stored); !slices.Equal(got, tt.wantNames) {
+				t.Fatalf("stored names = %q, want %q", got, tt.wantNames)
+			}
+		})
+	}
+}
+
+func TestUpsertUser(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	first := &User{Name: "Jack", Email: "jack@example.com", Age: 50}
+	if err := UpsertUser(ctx, db, first); err != nil {
+		t.Fatal(err)
+	}
+	second := &User{Name: "Captain Jack", Email: "jack@example.com", Age: 51}
+	if err := UpsertUser(ctx, db, second); err != nil {
+		t.Fatal(err)
+	}
+	if second.ID != first.ID {
+		t.Fatalf("second upsert returned id %d, want the existing row's id %d", second.ID, first.ID)
+	}
+
+	count, err := CountUsers(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Fatalf("%d rows after upserting one email twice, want 1", count)
+	}
+	stored, err := GetUserByID(ctx, db, first.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Name != "Captain Jack" || stored.Age != 51 {
+		t.Fatalf("stored user = %+v, want the second call's name and age", *stored)
+	}
+}
+
+func TestUpsertUserRestoresDeletedUser(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	deleted := &User{Name: "Jack", Email: "jack@example.com", Age: 50}
+	if err := CreateUser(ctx, db, deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := DeleteUser(ctx, db, deleted.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	user := &User{Name: "Captain Jack", Email: "jack@example.com", Age: 51}
+	if err := UpsertUser(ctx, db, user); err != nil {
+		t.Fatal(err)
+	}
+	if user.ID != deleted.ID || user.DeletedAt.Valid {
+		t.Fatalf("upserted user = %+v, want the deleted row %d restored", *user, deleted.ID)
+	}
+	stored, err := GetUserByID(ctx, db, deleted.ID)
+	if err != nil {
+		t.Fatalf("GetUserByID after upsert: %v", err)
+	}
+	if stored.Name != "Captain Jack" || stored.Age != 51 {
+		t.Fatalf("stored user = %+v, want the upserted name and age", *stored)
+	}
+}
+
+func TestCountUsers(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+
+	users := seedUsers(t, db, "Alice", "Bob", "Carol")
+	count, err := CountUsers(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Fatalf("count = %d, want 3", count)
+	}
+
+	// Soft deleted users are not counted
+	if err := DeleteUser(ctx, db, users[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if count, err = CountUsers(ctx, db); err != nil || count != 2 {
+		t.Fatalf("count after a delete = %d, %v, want 2", count, err)
+	}
+}
+
+func TestUserExistsByEmail(t *testing.T) {
+	db := openTestDB(t)
+	seedUsers(t, db, "Alice", "Bob")
+
+	tests := []struct {
+		email string
+		want  bool
+	}{
+		{"alice@example.com", true},
+		{"BOB@Example.com", true},
+		{"carol@example.com", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			got, err := UserExistsByEmail(context.Background(), db, tt.email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("UserExistsByEmail(%q) = %v, want %v", tt.email, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUserExistsByEmailQuery(t *testing.T) {
+	db, queries := dryRunDB(t)
+
+	if _, err := UserExistsByEmail(context.Background(), db, "a@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	want := `SELECT 1 FROM "users" WHERE LOWER(email) = LOWER('a@example.com') AND "users"."deleted_at" IS NULL LIMIT 1`
+	if len(*queries) != 1 || (*queries)[0] != want {
+		t.Fatalf("queries = %q, want %q", *queries, want)
+	}
+}
+
+func TestPoolConfigFromEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		want    PoolConfig
+		wantErr bool
+	}{
+		{"defaults", nil, PoolConfig{MaxOpenConns: 25, MaxIdleConns: 5, ConnMaxLifetime: 30 * time.Minute}, false},
+		{
+			"all set",
+			map[string]string{"DB_MAX_OPEN_CONNS": "50", "DB_MAX_IDLE_CONNS": "10", "DB_CONN_MAX_LIFETIME": "5m"},
+			PoolConfig{MaxOpenConns: 50, MaxIdleConns: 10, ConnMaxLifetime: 5 * time.Minute},
+			false,
+		},
+		{"bad open conns", map[string]string{"DB_MAX_OPEN_CONNS": "many"}, PoolConfig{}, true},
+		{"bad idle conns", map[string]string{"DB_MAX_IDLE_CONNS": "1.5"}, PoolConfig{}, true},
+		{"bad lifetime", map[string]string{"DB_CONN_MAX_LIFETIME": "30"}, PoolConfig{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := PoolConfigFromEnv(fakeEnv(tt.env))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Fatalf("config = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigurePool(t *testing.T) {
+	db := openUnreachableDB(t)
+
+	if err := ConfigurePool(db, PoolConfig{MaxOpenConns: 7, MaxIdleConns: 3, ConnMaxLifetime: time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sqlDB.Stats().MaxOpenConnections; got != 7 {
+		t.Fatalf("MaxOpenConnections = %d, want 7", got)
+	}
+}
+
+func TestConnectWithRetry(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	errNotReady := errors.New("database is starting up")
+	tests := []struct {
+		name      string
+		failures  int
+		attempts  int
+		wantCalls int
+		wantErr   bool
+	}{
+		{"first try", 0, 3, 1, false},
+		{"after failures", 2, 3, 3, false},
+		{"gives up", 5, 3, 3, true},
+		{"at least one attempt", 0, 0, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want := &gorm.DB{}
+			calls := 0
+			open := func() (*gorm.DB, error) {
+				calls++
+				if calls <= tt.failures {
+					return nil, errNotReady
+				}
+				return want, nil
+			}
+
+			db, err := ConnectWithRetry(open, tt.attempts, time.Millisecond)
+			if calls != tt.wantCalls {
+				t.Fatalf("open was called %d times, want %d", calls, tt.wantCalls)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, errNotReady) || db != nil {
+					t.Fatalf("db = %v, err = %v, want the last error", db, err)
+				}
+				return
+			}
+			if err != nil || db != want {
+				t.Fatalf("db = %v, err = %v, want the opened db", db, err)
+			}
+		})
+	}
+}
+
+func TestPingDB(t *testing.T) {
+	t.Run("live", func(t *testing.T) {
+		db := openTestDB(t)
+		if err := PingDB(context.Background(), db); err != nil {
+			t.Fatalf("PingDB = %v, want nil", err)
+		}
+	})
+	t.Run("closed", func(t *testing.T) {
+		db := openUnreachableDB(t)
+		sqlDB, err := db.DB()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sqlDB.Close()
+		if err := PingDB(context.Background(), db); err == nil {
+			t.Fatal("PingDB of a closed connection = nil, want an error")
+		}
+	})
+	t.Run("unreachable", func(t *testing.T) {
+		db := openUnreachableDB(t)
+		if err := PingDB(context.Background(), db); err == nil {
+			t.Fatal("PingDB of an unreachable server = nil, want an error")
+		}
+	})
+}
+
+func TestGetUserByIDNotFound(t *testing.T) {
+	db := openTestDB(t)
+	users := seedUsers(t, db, "Alice")
+	ctx := context.Background()
+
+	found, err := GetUserByID(ctx, db, users[0].ID)
+	if err != nil || found.Name != "Alice" {
+		t.Fatalf("GetUserByID = %v, %v, want Alice", found, err)
+	}
+	if _, err := GetUserByID(ctx, db, users[0].ID+1); err != ErrUserNotFound {
+		t.Fatalf("err = %v, want %v", err, ErrUserNotFound)
+	}
+}
+
+func TestGetUserByIDOtherErrors(t *testing.T) {
+	db := openUnreachableDB(t)
+
+	_, err := GetUserByID(context.Background(), db, 1)
+	if err == nil || errors.Is(err, ErrUserNotFound) {
+		t.Fatalf("err = %v, want the connection error passed through", err)
+	}
+}
+
+func TestGetUserByEmail(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	if err := CreateUser(ctx, db, &User{Name: "Jack", Email: "Jack@X.com", Age: 50}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		email   string
+		wantErr error
+	}{
+		{"Jack@X.com", nil},
+		{"jack@x.com", nil},
+		{"JACK@X.COM", nil},
+		{"jill@x.com", ErrUserNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.email, func(t *testing.T) {
+			user, err := GetUserByEmail(ctx, db, tt.email)
+			if err != tt.wantErr {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && user.Email != "Jack@X.com" {
+				t.Fatalf("email = %q, want the stored spelling", user.Email)
+			}
+		})
+	}
+}
+
+func TestSearchUsersByName(t *testing.T) {
+	db := openTestDB(t)
+	seedUsers(t, db, "Alice Smith", "Bob Smithers", "Carol", "50% Club", "Team_Lead")
+
+	tests := []struct {
+		name  string
+		term  string
+		limit int
+		want  []string
+	}{
+		{"match ignoring case", "SMITH", 10, []string{"Alice Smith", "Bob Smithers"}},
+		{"limit caps results", "smith", 1, []string{"Alice Smith"}},
+		{"no match", "dave", 10, []string{}},
+		{"literal percent", "50%", 10, []string{"50% Club"}},
+		{"percent alone", "%", 10, []string{"50% Club"}},
+		{"literal underscore", "_", 10, []string{"Team_Lead"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users, err := SearchUsersByName(context.Background(), db, tt.term, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := userNames(users); !slices.Equal(got, tt.want) {
+				t.Fatalf("names = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSearchUsersByNameQuery(t *testing.T) {
+	tests := []struct {
+		name    string
+		term    string
+		limit   int
+		want    string
+		wantErr bool
+	}{
+		{"wildcards are escaped", `50%_\`, 5, `SELECT * FROM "users" WHERE name ILIKE '%50\%\_\\%' ESCAPE '\' AND "users"."deleted_at" IS NULL ORDER BY name LIMIT 5`, false},
+		{"limit is capped", "a", 1000, `SELECT * FROM "users" WHERE name ILIKE '%a%' ESCAPE '\' AND "users"."deleted_at" IS NULL ORDER BY name LIMIT 100`, false},
+		{"zero limit", "a", 0, "", true},
+		{"negative limit", "a", -1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, queries := dryRunDB(t)
+
+			_, err := SearchUsersByName(context.Background(), db, tt.term, tt.limit)
+			if tt.wantErr {
+				if err == nil || len(*queries) != 0 {
+					t.Fatalf("err = %v, queries = %q, want an error before any query", err, *queries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*queries) != 1 || (*queries)[0] != tt.want {
+				t.Fatalf("queries = %q\nwant      %q", *queries, tt.want)
+			}
+		})
+	}
+}
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
+	"strings"
 	"time"
 
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // Data Models
@@ -23,17 +26,32 @@ type Post struct {
 	Content   string `gorm:"type:text"`
 	UserID    uint   `gorm:"not null;index"`
 	User      User
-	Tags      []Tag `gorm:"many2many:post_tags;"`
+	Tags      []Tag     `gorm:"many2many:post_tags;"`
+	Comments  []Comment `gorm:"foreignKey:PostID"`
 	CreatedAt time.Time
 	UpdatedAt time.Time
 }
 
+type Comment struct {
+	ID        uint   `gorm:"primaryKey"`
+	PostID    uint   `gorm:"not null;index"`
+	Author    string `gorm:"not null"`
+	Body      string `gorm:"type:text;not null"`
+	CreatedAt time.Time
+}
+
 type Tag struct {
 	ID    uint   `gorm:"primaryKey"`
 	Name  string `gorm:"unique;not null"`
 	Posts []Post `gorm:"many2many:post_tags;"`
 }
 
+// A user along with how many posts they have written
+type UserWithPostCount struct {
+	User
+	PostCount int
+}
+
 // Connecting to the database
 func ConnectDB() (*gorm.DB, error) {
 	dsn := "host=localhost user=bipl dbname=gorm_demo port=5432 sslmode=disable"
@@ -41,7 +59,7 @@ func ConnectDB() (*gorm.DB, error) {
 	if err != nil {
 		return nil, err
 	}
-	if err := db.AutoMigrate(&User{}, &Post{}, &Tag{}); err != nil {
+	if err := db.AutoMigrate(&User{}, &Post{}, &Tag{}, &Comment{}); err != nil {
 		return nil, err
 	}
 	return db, nil
@@ -62,26 +80,47 @@ func GetUserWithPost(db *gorm.DB, userId uint) (*User, error) {
 	return &user, nil
 }
 
-// Create post with tag
+// Create post with tag, the tags and post are committed together
+// so a failed post leaves no new tags behind
 func CreatePostWithTag(db *gorm.DB, post *Post, tagNames []string) error {
-	var tags []Tag
-	for _, name := range tagNames {
-		var tag Tag
-		if err := db.FirstOrCreate(&tag, Tag{Name: name}).Error; err != nil {
-			return err
+	return db.Transaction(func(tx *gorm.DB) error {
+		var tags []Tag
+		for _, name := range tagNames {
+			var tag Tag
+			if err := tx.FirstOrCreate(&tag, Tag{Name: name}).Error; err != nil {
+				return err
+			}
+			tags = append(tags, tag)
 		}
-		tags = append(tags, tag)
-	}
-	post.Tags = tags
-	return db.Create(post).Error
+		post.Tags = tags
+		return tx.Create(post).Error
+	})
 }
 
-func GetPostWithTag(db *gorm.DB, tagName string) ([]Post, error) {
+// Most posts returned by a single GetPostWithTag or SearchPostsByTitle call
+const maxPostsPageSize = 100
+
+// Get a page of posts with the given tag, newest first. limit must be positive
+// and is capped at maxPostsPageSize.
+func GetPostWithTag(db *gorm.DB, tagName string, limit, offset int) ([]Post, error) {
+	// GORM drops a negative limit or offset from the query, which would load every post with the tag
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	if offset < 0 {
+		return nil, fmt.Errorf("offset must not be negative, got %d", offset)
+	}
+	limit = min(limit, maxPostsPageSize)
+
 	var posts []Post
 
 	err := db.Joins("JOIN post_tags ON post_tags.post_id = posts.id").
 		Joins("JOIN tags ON tags.id = post_tags.tag_id").
 		Where("tags.name = ?", tagName).
+		Order("posts.created_at DESC").
+		Order("posts.id DESC").
+		Limit(limit).
+		Offset(offset).
 		Preload("User").
 		Preload("Tags").
 		Find(&posts).Error
@@ -110,16 +149,209 @@ func AddTagToPost(db *gorm.DB, postID uint, tagNames []string) error {
 	return db.Model(&post).Association("Tags").Append(&tags)
 }
 
-func GetPostWithUserAndTags(db *gorm.DB, postID uint) (*Post, error) {
+// Same as AddTagToPost but with a fixed number of queries however many tags are given:
+// existing tags are loaded in one query and the missing ones created in one batch insert
+func AddTagsToPostBatch(db *gorm.DB, postID uint, tagNames []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var post Post
+		if err := tx.First(&post, postID).Error; err != nil {
+			return err
+		}
+
+		// Dropping duplicate names so each tag is only created once
+		seen := make(map[string]bool, len(tagNames))
+		names := make([]string, 0, len(tagNames))
+		for _, name := range tagNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if len(names) == 0 {
+			return nil
+		}
+
+		var existing []Tag
+		if err := tx.Where("name IN ?", names).Find(&existing).Error; err != nil {
+			return err
+		}
+		found := make(map[string]bool, len(existing))
+		for _, tag := range existing {
+			found[tag.Name] = true
+		}
+
+		var missing []Tag
+		for _, name := range names {
+			if !found[name] {
+				missing = append(missing, Tag{Name: name})
+			}
+		}
+		if len(missing) > 0 {
+			// Another writer may create the same tag in the meantime, so conflicts are skipped
+			// and the created tags are picked up by the reload below
+			if err := tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&missing).Error; err != nil {
+				return err
+			}
+			existing = nil
+			if err := tx.Where("name IN ?", names).Find(&existing).Error; err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&post).Association("Tags").Append(&existing)
+	})
+}
+
+// Detach tags from a post, the tags themselves are kept
+func RemoveTagFromPost(db *gorm.DB, postID uint, tagNames []string) error {
 	var post Post
-	if err := db.Preload("User").
-		Preload("Tags").
-		First(&post, postID).Error; err != nil {
+	if err := db.First(&post, postID).Error; err != nil {
+		return err
+	}
+
+	var tags []Tag
+	if err := db.Where("name IN ?", tagNames).Find(&tags).Error; err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	return db.Model(&post).Association("Tags").Delete(&tags)
+}
+
+// Set a post's tags to exactly the given names, creating missing tags
+func ReplacePostTags(db *gorm.DB, postID uint, tagNames []string) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		var post Post
+		if err := tx.First(&post, postID).Error; err != nil {
+			return err
+		}
+
+		tags := []Tag{}
+		for _, name := range tagNames {
+			var tag Tag
+			if err := tx.FirstOrCreate(&tag, Tag{Name: name}).Error; err != nil {
+				return err
+			}
+			tags = append(tags, tag)
+		}
+
+		return tx.Model(&post).Association("Tags").Replace(&tags)
+	})
+}
+
+// Delete tags that are not attached to any post, returning how many were removed
+func DeleteOrphanedTags(db *gorm.DB) (int64, error) {
+	result := db.Where("NOT EXISTS (SELECT 1 FROM post_tags WHERE post_tags.tag_id = tags.id)").
+		Delete(&Tag{})
+	return result.RowsAffected, result.Error
+}
+
+// Get a post with its author and tags, and its comments too when withComments is set
+func GetPostWithUserAndTags(db *gorm.DB, postID uint, withComments bool) (*Post, error) {
+	query := db.Preload("User").Preload("Tags")
+	if withComments {
+		query = query.Preload("Comments", func(db *gorm.DB) *gorm.DB {
+			return db.Order("comments.created_at")
+		})
+	}
+
+	var post Post
+	if err := query.First(&post, postID).Error; err != nil {
+		return nil, err
+	}
+	return &post, nil
+}
+
+// Add a comment to an existing post
+func AddCommentToPost(db *gorm.DB, postID uint, comment *Comment) error {
+	var post Post
+	if err := db.First(&post, postID).Error; err != nil {
+		return err
+	}
+	comment.PostID = post.ID
+	return db.Create(comment).Error
+}
+
+// Get a post with its comments, oldest first
+func GetPostWithComments(db *gorm.DB, postID uint) (*Post, error) {
+	var post Post
+	if err := db.Preload("Comments", func(db *gorm.DB) *gorm.DB {
+		return db.Order("comments.created_at")
+	}).First(&post, postID).Error; err != nil {
 		return nil, err
 	}
 	return &post, nil
 }
 
+// Escapes the LIKE wildcards in a search term so it only matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// Find up to limit posts whose title contains term ignoring case, newest first.
+// limit must be positive and is capped at maxPostsPageSize.
+func SearchPostsByTitle(db *gorm.DB, term string, limit int) ([]Post, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("limit must be positive, got %d", limit)
+	}
+	limit = min(limit, maxPostsPageSize)
+
+	var posts []Post
+	pattern := "%" + likeEscaper.Replace(term) + "%"
+	err := db.Where(`title ILIKE ? ESCAPE '\'`, pattern).
+		Order("created_at DESC").
+		Limit(limit).
+		Preload("User").
+		Preload("Tags").
+		Find(&posts).Error
+	if err != nil {
+		return nil, err
+	}
+	return posts, nil
+}
+
+// Get every user with their number of posts, users without posts get a count of 0
+func GetUsersWithPostCount(db *gorm.DB) ([]UserWithPostCount, error) {
+	var results []UserWithPostCount
+	err := db.Model(&User{}).
+		Select("users.*, COUNT(posts.id) AS post_count").
+		Joins("LEFT JOIN posts ON posts.user_id = users.id").
+		Group("users.id").
+		Order("users.id").
+		Scan(&results).Error
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// Delete a user together with their posts and the posts' comments and tag links
+func DeleteUserAndPosts(db *gorm.DB, userID uint) error {
+	return db.Transaction(func(tx *gorm.DB) error {
+		// Comments and join table rows go first so the posts are no longer referenced
+		if err := tx.Where("post_id IN (?)", tx.Model(&Post{}).Select("id").Where("user_id = ?", userID)).
+			Delete(&Comment{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec(
+			"DELETE FROM post_tags WHERE post_id IN (SELECT id FROM posts WHERE user_id = ?)", userID,
+		).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", userID).Delete(&Post{}).Error; err != nil {
+			return err
+		}
+		result := tx.Delete(&User{}, userID)
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return gorm.ErrRecordNotFound
+		}
+		return nil
+	})
+}
+
 func main() {
 
 }
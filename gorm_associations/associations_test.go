@@ -0,0 +1,579 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Schema the database tests create their tables in. go test runs packages in
+// parallel and the gorm package has a users table of its own, so each package
+// keeps to its own schema.
+const testSchema = "gorm_associations_test"
+
+// Helper function connecting to the Postgres database in TEST_DATABASE_DSN, skipping
+// the test when it isn't set. All tables are emptied so every test starts clean.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RuntimeParams["search_path"] = testSchema
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: stdlib.OpenDB(*config)}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	if err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + testSchema).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AutoMigrate(&User{}, &Post{}, &Tag{}, &Comment{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("TRUNCATE users, posts, tags, comments, post_tags RESTART IDENTITY").Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Helper function returning a dry run session on a server that isn't there, along
+// with the SQL of every query it was asked to run. database/sql only dials on first
+// use, so tests that never reach the server can run without Postgres.
+func dryRunDB(t *testing.T) (*gorm.DB, *[]string) {
+	t.Helper()
+	db, err := gorm.Open(postgres.Open("host=127.0.0.1 port=1 user=test dbname=test sslmode=disable connect_timeout=1"), &gorm.Config{
+		DisableAutomaticPing: true,
+		DryRun:               true,
+		Logger:               logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+
+	var queries []string
+	err = db.Callback().Query().After("gorm:query").Register("test:record", func(tx *gorm.DB) {
+		queries = append(queries, tx.Dialector.Explain(tx.Statement.SQL.String(), tx.Statement.Vars...))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db, &queries
+}
+
+// Helper function creating a user with a post for each of the given titles
+func createUser(t *testing.T, db *gorm.DB, name string, titles ...string) *User {
+	t.Helper()
+	user := &User{Name: name, Email: name + "@example.com"}
+	for _, title := range titles {
+		user.Posts = append(user.Posts, Post{Title: title, Content: "About " + title})
+	}
+	if err := CreateUserWithPost(db, user); err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+// Helper function creating a post for each title by author, each one an hour newer than
+// the one before, and attaching the given tags to all of them
+func createDatedPosts(t *testing.T, db *gorm.DB, author *User, tagNames []string, titles ...string) []Post {
+	t.Helper()
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	posts := make([]Post, len(titles))
+	for i, title := range titles {
+		posts[i] = Post{Title: title, UserID: author.ID, CreatedAt: start.Add(time.Duration(i) * time.Hour)}
+		if err := CreatePostWithTag(db, &posts[i], tagNames); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return posts
+}
+
+// Helper function listing the titles of posts in order
+func postTitles(posts []Post) []string {
+	titles := make([]string, len(posts))
+	for i, post := range posts {
+		titles[i] = post.Title
+	}
+	return titles
+}
+
+// Helper function counting the rows of model matching the query and args
+func countRows(t *testing.T, db *gorm.DB, model interface{}, query string, args ...interface{}) int64 {
+	t.Helper()
+	var count int64
+	if err := db.Model(model).Where(query, args...).Count(&count).Error; err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+// Helper function listing the names of the tags attached to a post, sorted
+func postTagNames(t *testing.T, db *gorm.DB, postID uint) []string {
+	t.Helper()
+	post, err := GetPostWithUserAndTags(db, postID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(post.Tags))
+	for i, tag := range post.Tags {
+		names[i] = tag.Name
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestDeleteUserAndPosts(t *testing.T) {
+	db := openTestDB(t)
+	author := createUser(t, db, "author", "First", "Second")
+	other := createUser(t, db, "other", "Kept")
+	if err := AddTagToPost(db, author.Posts[0].ID, []string{"go"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddCommentToPost(db, author.Posts[0].ID, &Comment{Author: "reader", Body: "Nice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := DeleteUserAndPosts(db, author.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := countRows(t, db, &User{}, "id = ?", author.ID); n != 0 {
+		t.Fatalf("the user is still there")
+	}
+	if n := countRows(t, db, &Post{}, "user_id = ?", author.ID); n != 0 {
+		t.Fatalf("%d posts of the deleted user remain", n)
+	}
+	if n := countRows(t, db, &Comment{}, "post_id = ?", author.Posts[0].ID); n != 0 {
+		t.Fatalf("%d comments of the deleted posts remain", n)
+	}
+	var links int64
+	if err := db.Table("post_tags").Where("post_id = ?", author.Posts[0].ID).Count(&links).Error; err != nil {
+		t.Fatal(err)
+	}
+	if links != 0 {
+		t.Fatalf("%d tag links of the deleted posts remain", links)
+	}
+
+	if n := countRows(t, db, &Post{}, "user_id = ?", other.ID); n != 1 {
+		t.Fatalf("the other user has %d posts left, want 1", n)
+	}
+	if n := countRows(t, db, &Tag{}, "name = ?", "go"); n != 1 {
+		t.Fatalf("the tag was deleted along with the posts")
+	}
+
+	if err := DeleteUserAndPosts(db, author.ID); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("deleting a missing user: err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestRemoveTagFromPost(t *testing.T) {
+	db := openTestDB(t)
+	post := createUser(t, db, "author", "Tagged").Posts[0]
+	if err := AddTagToPost(db, post.ID, []string{"go", "gorm"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveTagFromPost(db, post.ID, []string{"go"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := postTagNames(t, db, post.ID); !slices.Equal(got, []string{"gorm"}) {
+		t.Fatalf("tags = %q, want only gorm", got)
+	}
+	if n := countRows(t, db, &Tag{}, "name = ?", "go"); n != 1 {
+		t.Fatalf("the detached tag was deleted")
+	}
+
+	// Names the post isn't tagged with are ignored
+	if err := RemoveTagFromPost(db, post.ID, []string{"rust"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveTagFromPost(db, post.ID+100, []string{"gorm"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("missing post: err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestReplacePostTags(t *testing.T) {
+	db := openTestDB(t)
+	post := createUser(t, db, "author", "Tagged").Posts[0]
+	if err := AddTagToPost(db, post.ID, []string{"A", "B"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ReplacePostTags(db, post.ID, []string{"B", "C"}); err != nil {
+		t.Fatal(err)
+	}
+	if got := postTagNames(t, db, post.ID); !slices.Equal(got, []string{"B", "C"}) {
+		t.Fatalf("tags = %q, want exactly B and C", got)
+	}
+	if n := countRows(t, db, &Tag{}, "name IN ?", []string{"A", "B", "C"}); n != 3 {
+		t.Fatalf("%d tags exist, want A kept and C created alongside B", n)
+	}
+
+	if err := ReplacePostTags(db, post.ID, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := postTagNames(t, db, post.ID); len(got) != 0 {
+		t.Fatalf("tags = %q after replacing with none", got)
+	}
+
+	if err := ReplacePostTags(db, post.ID+100, []string{"D"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("missing post: err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+	if n := countRows(t, db, &Tag{}, "name = ?", "D"); n != 0 {
+		t.Fatalf("a tag was created for a missing post")
+	}
+}
+
+func TestDeleteOrphanedTags(t *testing.T) {
+	db := openTestDB(t)
+	posts := createUser(t, db, "author", "First", "Second").Posts
+	if err := AddTagToPost(db, posts[0].ID, []string{"orphan", "used"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := AddTagToPost(db, posts[1].ID, []string{"orphan"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, post := range posts {
+		if err := RemoveTagFromPost(db, post.ID, []string{"orphan"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := DeleteOrphanedTags(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if removed != 1 {
+		t.Fatalf("removed %d tags, want 1", removed)
+	}
+	if n := countRows(t, db, &Tag{}, "name = ?", "orphan"); n != 0 {
+		t.Fatal("the orphaned tag survived the cleanup")
+	}
+	if got := postTagNames(t, db, posts[0].ID); !slices.Equal(got, []string{"used"}) {
+		t.Fatalf("tags = %q, want the used tag kept", got)
+	}
+
+	if removed, err := DeleteOrphanedTags(db); err != nil || removed != 0 {
+		t.Fatalf("second cleanup removed %d tags, err %v, want nothing", removed, err)
+	}
+}
+
+func TestGetPostWithTag(t *testing.T) {
+	db := openTestDB(t)
+	author := createUser(t, db, "author")
+	createDatedPosts(t, db, author, []string{"go"}, "P1", "P2", "P3", "P4", "P5")
+	createDatedPosts(t, db, author, []string{"rust"}, "Other")
+
+	tests := []struct {
+		name   string
+		limit  int
+		offset int
+		want   []string
+	}{
+		{"first page", 2, 0, []string{"P5", "P4"}},
+		{"middle page", 2, 2, []string{"P3", "P2"}},
+		{"last page", 2, 4, []string{"P1"}},
+		{"past the end", 2, 6, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts, err := GetPostWithTag(db, "go", tt.limit, tt.offset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := postTitles(posts); !slices.Equal(got, tt.want) {
+				t.Fatalf("titles = %q, want %q", got, tt.want)
+			}
+			for _, post := range posts {
+				if post.User.Name != "author" || len(post.Tags) != 1 {
+					t.Fatalf("post %s was loaded without its user or tags: %+v", post.Title, post)
+				}
+			}
+		})
+	}
+}
+
+func TestGetPostWithTagQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		offset    int
+		wantLimit string
+		wantErr   bool
+	}{
+		{"page", 10, 20, "LIMIT 10 OFFSET 20", false},
+		{"limit is capped", 1000, 0, "LIMIT 100", false},
+		{"zero limit", 0, 0, "", true},
+		{"negative limit", -1, 0, "", true},
+		{"negative offset", 10, -1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, queries := dryRunDB(t)
+
+			_, err := GetPostWithTag(db, "go", tt.limit, tt.offset)
+			if tt.wantErr {
+				if err == nil || len(*queries) != 0 {
+					t.Fatalf("err = %v, queries = %q, want an error before any query", err, *queries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*queries) != 1 || !strings.HasSuffix((*queries)[0], tt.wantLimit) {
+				t.Fatalf("queries = %q, want one ending in %q", *queries, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestCreatePostWithTagRollsBack(t *testing.T) {
+	db := openTestDB(t)
+	author := createUser(t, db, "author")
+	createDatedPosts(t, db, author, []string{"existing"}, "Earlier")
+
+	// No user has this id, so the post insert breaks the foreign key after the tags were created
+	post := &Post{Title: "Orphan", UserID: author.ID + 100}
+	if err := CreatePostWithTag(db, post, []string{"existing", "fresh"}); err == nil {
+		t.Fatal("creating a post for a missing user succeeded")
+	}
+
+	if n := countRows(t, db, &Tag{}, "name = ?", "fresh"); n != 0 {
+		t.Fatal("the new tag was committed without its post")
+	}
+	if n := countRows(t, db, &Tag{}, "name = ?", "existing"); n != 1 {
+		t.Fatal("the existing tag was lost")
+	}
+	if n := countRows(t, db, &Post{}, "title = ?", "Orphan"); n != 0 {
+		t.Fatal("the failed post was stored")
+	}
+}
+
+func TestGetUsersWithPostCount(t *testing.T) {
+	db := openTestDB(t)
+	createUser(t, db, "prolific", "One", "Two", "Three")
+	createUser(t, db, "single", "Only")
+	createUser(t, db, "silent")
+
+	results, err := GetUsersWithPostCount(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{"prolific": 3, "single": 1, "silent": 0}
+	if len(results) != len(want) {
+		t.Fatalf("got %d users, want %d", len(results), len(want))
+	}
+	for _, result := range results {
+		if result.PostCount != want[result.Name] {
+			t.Fatalf("%s has a post count of %d, want %d", result.Name, result.PostCount, want[result.Name])
+		}
+		if result.Email != result.Name+"@example.com" {
+			t.Fatalf("user fields were not loaded: %+v", result.User)
+		}
+	}
+}
+
+func TestPostComments(t *testing.T) {
+	db := openTestDB(t)
+	post := createUser(t, db, "author", "Discussed").Posts[0]
+	other := createUser(t, db, "other", "Quiet").Posts[0]
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	// Added newest first, they come back oldest first
+	for i, body := range []string{"Second", "First"} {
+		comment := &Comment{Author: "reader", Body: body, CreatedAt: start.Add(time.Duration(-i) * time.Hour)}
+		if err := AddCommentToPost(db, post.ID, comment); err != nil {
+			t.Fatal(err)
+		}
+		if comment.PostID != post.ID {
+			t.Fatalf("comment post id = %d, want %d", comment.PostID, post.ID)
+		}
+	}
+
+	commentBodies := func(p *Post) []string {
+		bodies := make([]string, len(p.Comments))
+		for i, comment := range p.Comments {
+			bodies[i] = comment.Body
+		}
+		return bodies
+	}
+
+	withComments, err := GetPostWithComments(db, post.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commentBodies(withComments); !slices.Equal(got, []string{"First", "Second"}) {
+		t.Fatalf("comments = %q, want First then Second", got)
+	}
+
+	full, err := GetPostWithUserAndTags(db, post.ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := commentBodies(full); !slices.Equal(got, []string{"First", "Second"}) || full.User.Name != "author" {
+		t.Fatalf("post with comments = %+v", full)
+	}
+	bare, err := GetPostWithUserAndTags(db, post.ID, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bare.Comments) != 0 {
+		t.Fatalf("comments were loaded without asking for them: %q", commentBodies(bare))
+	}
+
+	quiet, err := GetPostWithComments(db, other.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(quiet.Comments) != 0 {
+		t.Fatalf("comments of another post were loaded: %q", commentBodies(quiet))
+	}
+
+	if err := AddCommentToPost(db, post.ID+100, &Comment{Author: "reader", Body: "Lost"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("commenting on a missing post: err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
+
+func TestSearchPostsByTitle(t *testing.T) {
+	db := openTestDB(t)
+	author := createUser(t, db, "author")
+	createDatedPosts(t, db, author, []string{"go"}, "Learning Gin", "Gorm basics", "Gin middleware", "100% coverage")
+
+	tests := []struct {
+		name  string
+		term  string
+		limit int
+		want  []string
+	}{
+		{"match newest first", "GIN", 10, []string{"Gin middleware", "Learning Gin"}},
+		{"limit", "gin", 1, []string{"Gin middleware"}},
+		{"no match", "rust", 10, []string{}},
+		{"literal percent", "0%", 10, []string{"100% coverage"}},
+		{"percent alone", "%", 10, []string{"100% coverage"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			posts, err := SearchPostsByTitle(db, tt.term, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := postTitles(posts); !slices.Equal(got, tt.want) {
+				t.Fatalf("titles = %q, want %q", got, tt.want)
+			}
+			for _, post := range posts {
+				if post.User.Name != "author" || len(post.Tags) != 1 {
+					t.Fatalf("post %s was loaded without its user or tags: %+v", post.Title, post)
+				}
+			}
+		})
+	}
+}
+
+func TestSearchPostsByTitleQuery(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		wantLimit string
+		wantErr   bool
+	}{
+		{"limit", 10, "LIMIT 10", false},
+		{"limit is capped", 1000, "LIMIT 100", false},
+		{"zero limit", 0, "", true},
+		{"negative limit", -1, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, queries := dryRunDB(t)
+
+			_, err := SearchPostsByTitle(db, "gin", tt.limit)
+			if tt.wantErr {
+				if err == nil || len(*queries) != 0 {
+					t.Fatalf("err = %v, queries = %q, want an error before any query", err, *queries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(*queries) != 1 || !strings.HasSuffix((*queries)[0], tt.wantLimit) {
+				t.Fatalf("queries = %q, want one ending in %q", *queries, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAddTagsToPostBatch(t *testing.T) {
+	db := openTestDB(t)
+	posts := createUser(t, db, "author", "First", "Second").Posts
+	// tag-0 to tag-9 exist already through another post
+	var existing []string
+	for i := 0; i < 10; i++ {
+		existing = append(existing, "tag-"+strconv.Itoa(i))
+	}
+	if err := AddTagToPost(db, posts[1].ID, existing); err != nil {
+		t.Fatal(err)
+	}
+
+	// 500 names with every tag given twice
+	var names, want []string
+	for i := 0; i < 250; i++ {
+		name := "tag-" + strconv.Itoa(i)
+		names = append(names, name, name)
+		want = append(want, name)
+	}
+	slices.Sort(want)
+
+	// A second call with the same names must not add anything
+	for range 2 {
+		if err := AddTagsToPostBatch(db, posts[0].ID, names); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := postTagNames(t, db, posts[0].ID); !slices.Equal(got, want) {
+		t.Fatalf("post has %d tags, want %d", len(got), len(want))
+	}
+	if n := countRows(t, db, &Tag{}, "name LIKE ?", "tag-%"); n != 250 {
+		t.Fatalf("%d tags exist, want 250 without duplicates", n)
+	}
+	var links int64
+	if err := db.Table("post_tags").Where("post_id = ?", posts[0].ID).Count(&links).Error; err != nil {
+		t.Fatal(err)
+	}
+	if links != 250 {
+		t.Fatalf("%d tag links, want 250", links)
+	}
+	if got := postTagNames(t, db, posts[1].ID); len(got) != len(existing) {
+		t.Fatalf("the other post's tags changed: %q", got)
+	}
+
+	if err := AddTagsToPostBatch(db, posts[0].ID+100, []string{"lost"}); !errors.Is(err, gorm.ErrRecordNotFound) {
+		t.Fatalf("missing post: err = %v, want %v", err, gorm.ErrRecordNotFound)
+	}
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Row of the articles table. Soft deletes are tracked by hand through Deleted
+// and DeletedAt, like the in-memory store, instead of gorm.DeletedAt.
+type articleRecord struct {
+	ID        int      `gorm:"primaryKey"`
+	Title     string   `gorm:"size:200;not null"`
+	Content   string   `gorm:"type:text;not null"`
+	Author    string   `gorm:"size:100;not null;index"`
+	Category  string   `gorm:"size:50;index"`
+	Tags      []string `gorm:"type:jsonb;serializer:json"`
+	CreatedAt time.Time
+	UpdatedAt time.Time
+	Deleted   bool `gorm:"not null;default:false;index"`
+	DeletedAt *time.Time
+	Version   int `gorm:"not null;default:1"`
+}
+
+func (articleRecord) TableName() string {
+	return "articles"
+}
+
+func (r articleRecord) article() Article {
+	return Article{
+		ID:        r.ID,
+		Title:     r.Title,
+		Content:   r.Content,
+		Author:    r.Author,
+		Category:  r.Category,
+		Tags:      r.Tags,
+		CreatedAt: r.CreatedAt,
+		UpdatedAt: r.UpdatedAt,
+		Deleted:   r.Deleted,
+		DeletedAt: r.DeletedAt,
+		Version:   r.Version,
+	}
+}
+
+func recordFromArticle(a Article) articleRecord {
+	return articleRecord{
+		ID:        a.ID,
+		Title:     a.Title,
+		Content:   a.Content,
+		Author:    a.Author,
+		Category:  a.Category,
+		Tags:      a.Tags,
+		CreatedAt: a.CreatedAt,
+		UpdatedAt: a.UpdatedAt,
+		Deleted:   a.Deleted,
+		DeletedAt: a.DeletedAt,
+		Version:   a.Version,
+	}
+}
+
+// Escapes the LIKE wildcards in a search term so it only matches literally
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// ArticleStore backed by a Postgres database through GORM. Like the in-memory
+// store it holds at most maxArticles articles, soft-deleted ones included; 0
+// means no limit.
+//
+// Changes are published to events after their transaction commits. Writes hold
+// writeMu until then, so subscribers see this process's changes in commit order.
+type GormArticleStore struct {
+	db          *gorm.DB
+	maxArticles int
+	events      *articleBroker
+	writeMu     sync.Mutex
+}
+
+// Opens the database at dsn and migrates the articles table
+func OpenGormArticleStore(dsn string, maxArticles int, events *articleBroker) (*GormArticleStore, error) {
+	db, err := gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return NewGormArticleStore(db, maxArticles, events)
+}
+
+func NewGormArticleStore(db *gorm.DB, maxArticles int, events *articleBroker) (*GormArticleStore, error) {
+	if err := db.AutoMigrate(&articleRecord{}); err != nil {
+		return nil, err
+	}
+	return &GormArticleStore{db: db, maxArticles: maxArticles, events: events}, nil
+}
+
+// Runs fn in a transaction and publishes the events it returns once committed
+func (s *GormArticleStore) write(fn func(tx *gorm.DB) ([]ArticleEvent, error)) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	var events []ArticleEvent
+	err := s.db.Transaction(func(tx *gorm.DB) error {
+		var err error
+		events, err = fn(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		s.events.publish(event)
+	}
+	return nil
+}
+
+func (s *GormArticleStore) List(filter ArticleFilter) ([]Article, error) {
+	query := s.db.Model(&articleRecord{})
+	if !filter.IncludeDeleted {
+		query = query.Where("deleted = ?", false)
+	}
+	if filter.Author != "" {
+		query = query.Where("LOWER(author) = LOWER(?)", filter.Author)
+	}
+	if filter.Category != "" {
+		query = query.Where("category = ?", filter.Category)
+	}
+	if filter.Tag != "" {
+		// @> matches arrays containing every element of the given one
+		tag, err := json.Marshal([]string{filter.Tag})
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where("tags @> ?", string(tag))
+	}
+	if filter.Query != "" {
+		pattern := "%" + likeEscaper.Replace(filter.Query) + "%"
+		query = query.Where(`(title ILIKE ? ESCAPE '\' OR content ILIKE ? ESCAPE '\')`, pattern, pattern)
+	}
+
+	var records []articleRecord
+	if err := query.Order("id").Find(&records).Error; err != nil {
+		return nil, err
+	}
+	list := make([]Article, len(records))
+	for i, r := range records {
+		list[i] = r.article()
+	}
+	return list, nil
+}
+
+func (s *GormArticleStore) Get(id int, includeDeleted bool) (Article, error) {
+	record, err := findArticleRecord(s.db, id, includeDeleted)
+	if err != nil {
+		return Article{}, err
+	}
+	return record.article(), nil
+}
+
+func (s *GormArticleStore) Create(articles ...Article) ([]Article, error) {
+	if len(articles) == 0 {
+		return []Article{}, nil
+	}
+
+	now := time.Now()
+	records := make([]articleRecord, len(articles))
+	for i, a := range articles {
+		records[i] = recordFromArticle(a)
+		records[i].ID = 0
+		records[i].CreatedAt = now
+		records[i].UpdatedAt = now
+		records[i].Deleted = false
+		records[i].DeletedAt = nil
+		records[i].Version = 1
+	}
+	var created []Article
+	err := s.write(func(tx *gorm.DB) ([]ArticleEvent, error) {
+		if s.maxArticles > 0 {
+			// The lock conflicts with itself and with inserts, so concurrent creates
+			// wait for each other and can't both fit under the cap
+			if err := tx.Exec("LOCK TABLE articles IN SHARE ROW EXCLUSIVE MODE").Error; err != nil {
+				return nil, err
+			}
+			var count int64
+			if err := tx.Model(&articleRecord{}).Count(&count).Error; err != nil {
+				return nil, err
+			}
+			if int(count)+len(records) > s.maxArticles {
+				return nil, ErrArticleLimit
+			}
+		}
+		if err := tx.Create(&records).Error; err != nil {
+			return nil, err
+		}
+
+		created = make([]Article, len(records))
+		events := make([]ArticleEvent, len(records))
+		for i, r := range records {
+			created[i] = r.article()
+			events[i] = ArticleEvent{Type: "created", Article: created[i]}
+		}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return created, nil
+}
+
+func (s *GormArticleStore) Update(id int, fn func(a *Article) error) (Article, error) {
+	var updated Article
+	err := s.write(func(tx *gorm.DB) ([]ArticleEvent, error) {
+		// The row stays locked until the transaction ends so concurrent
+		// updates can't both pass a version check
+		record, err := findArticleRecord(tx.Clauses(clause.Locking{Strength: "UPDATE"}), id, false)
+		if err != nil {
+			return nil, err
+		}
+		article := record.article()
+		if err := fn(&article); err != nil {
+			return nil, err
+		}
+		saved := recordFromArticle(article)
+		saved.ID = id
+		saved.CreatedAt = record.CreatedAt
+		saved.UpdatedAt = time.Now()
+		saved.Version = record.Version + 1
+		if err := tx.Save(&saved).Error; err != nil {
+			return nil, err
+		}
+		updated = saved.article()
+		return []ArticleEvent{{Type: "updated", Article: updated}}, nil
+	})
+	if err != nil {
+		return Article{}, err
+	}
+	return updated, nil
+}
+
+func (s *GormArticleStore) Delete(id int) (Article, error) {
+	return s.setDeleted(id, true)
+}
+
+// Every change sets updated_at except deletes, which only set deleted_at.
+// GREATEST skips NULLs, so articles that were never deleted don't matter.
+func (s *GormArticleStore) LastModified() (time.Time, error) {
+	var lastModified sql.NullTime
+	if err := s.db.Model(&articleRecord{}).
+		Select("GREATEST(MAX(updated_at), MAX(deleted_at))").
+		Scan(&lastModified).Error; err != nil {
+		return time.Time{}, err
+	}
+	// NULL when the table is empty, reported as the zero time
+	return lastModified.Time, nil
+}
+
+func (s *GormArticleStore) DeleteMany(ids []int) ([]Article, error) {
+	var deleted []Article
+	err := s.write(func(tx *gorm.DB) ([]ArticleEvent, error) {
+		var records []articleRecord
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).
+			Where("id IN ? AND deleted = ?", ids, false).
+			Order("id").
+			Find(&records).Error; err != nil {
+			return nil, err
+		}
+		if len(records) == 0 {
+			return nil, nil
+		}
+
+		now := time.Now()
+		found := make([]int, len(records))
+		for i := range records {
+			found[i] = records[i].ID
+			records[i].Deleted = true
+			records[i].DeletedAt = &now
+		}
+		if err := tx.Model(&articleRecord{}).Where("id IN ?", found).
+			UpdateColumns(map[string]interface{}{"deleted": true, "deleted_at": now}).Error; err != nil {
+			return nil, err
+		}
+		deleted = make([]Article, len(records))
+		events := make([]ArticleEvent, len(records))
+		for i, r := range records {
+			deleted[i] = r.article()
+			events[i] = ArticleEvent{Type: "deleted", Article: deleted[i]}
+		}
+		return events, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (s *GormArticleStore) Restore(id int) (Article, error) {
+	return s.setDeleted(id, false)
+}
+
+// Soft-deletes or restores an article, failing if it is already in that state
+func (s *GormArticleStore) setDeleted(id int, deleted bool) (Article, error) {
+	var result Article
+	err := s.write(func(tx *gorm.DB) ([]ArticleEvent, error) {
+		// Restoring has to find deleted articles, deleting only live ones
+		record, err := findArticleRecord(tx.Clauses(clause.Locking{Strength: "UPDATE"}), id, !deleted)
+		if err != nil {
+			return nil, err
+		}
+		if !deleted && !record.Deleted {
+			return nil, ErrArticleNotDeleted
+		}
+
+		// UpdateColumns leaves updated_at alone, so a delete doesn't count as an edit
+		now := time.Now()
+		changes := map[string]interface{}{"deleted": deleted, "deleted_at": nil}
+		record.Deleted = deleted
+		record.DeletedAt = nil
+		if deleted {
+			changes["deleted_at"] = now
+			record.DeletedAt = &now
+		} else {
+			changes["updated_at"] = now
+			record.UpdatedAt = now
+		}
+		if err := tx.Model(&articleRecord{}).Where("id = ?", id).UpdateColumns(changes).Error; err != nil {
+			return nil, err
+		}
+		result = record.article()
+		eventType := "restored"
+		if deleted {
+			eventType = "deleted"
+		}
+		return []ArticleEvent{{Type: eventType, Article: result}}, nil
+	})
+	if err != nil {
+		return Article{}, err
+	}
+	return result, nil
+}
+
+func findArticleRecord(db *gorm.DB, id int, includeDeleted bool) (articleRecord, error) {
+	query := db.Where("id = ?", id)
+	if !includeDeleted {
+		query = query.Where("deleted = ?", false)
+	}
+
+	var record articleRecord
+	if err := query.First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return articleRecord{}, ErrArticleNotFound
+		}
+		return articleRecord{}, err
+	}
+	return record, nil
+}
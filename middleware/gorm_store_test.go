@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/stdlib"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// Schema holding the tables of these tests, so they can share a database with
+// the tests of the other packages
+const testSchema = "middleware_test"
+
+// Helper function connecting to the database named by TEST_DATABASE_DSN, skipping
+// the test when it isn't set. The articles table is dropped so every test starts
+// from an empty table migrated by the store.
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	config, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.RuntimeParams["search_path"] = testSchema
+	db, err := gorm.Open(postgres.New(postgres.Config{Conn: stdlib.OpenDB(*config)}), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqlDB, err := db.DB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { sqlDB.Close() })
+	if err := db.Exec("CREATE SCHEMA IF NOT EXISTS " + testSchema).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec("DROP TABLE IF EXISTS articles").Error; err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// Helper function creating a store on db, failing the test on error
+func newTestGormStore(t *testing.T, db *gorm.DB, maxArticles int, events *articleBroker) *GormArticleStore {
+	t.Helper()
+	store, err := NewGormArticleStore(db, maxArticles, events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestGormArticleStore(t *testing.T) {
+	testArticleStore(t, func(t *testing.T, events *articleBroker) ArticleStore {
+		return newTestGormStore(t, openTestDB(t), 0, events)
+	})
+}
+
+func TestGormArticleStoreSurvivesRestart(t *testing.T) {
+	db := openTestDB(t)
+	created, err := newTestGormStore(t, db, 0, nil).Create(Article{
+		Title: "Persisted", Content: "Still here", Author: "Ann", Category: "news", Tags: []string{"go", "gorm"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newTestGormStore(t, db, 0, nil).Delete(created[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	// A new store on the same database sees what the first one wrote,
+	// including the soft delete, and migrating again keeps the rows
+	store := newTestGormStore(t, db, 0, nil)
+	if _, err := store.Get(created[0].ID, false); !errors.Is(err, ErrArticleNotFound) {
+		t.Fatalf("Get without deleted: error %v, want %v", err, ErrArticleNotFound)
+	}
+	got, err := store.Get(created[0].ID, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Persisted" || got.Content != "Still here" || got.Author != "Ann" || got.Category != "news" ||
+		!slices.Equal(got.Tags, []string{"go", "gorm"}) || !got.Deleted || got.DeletedAt == nil {
+		t.Fatalf("reloaded article %+v", got)
+	}
+
+	restored, err := store.Restore(created[0].ID)
+	if err != nil || restored.Deleted {
+		t.Fatalf("Restore: article %+v, error %v", restored, err)
+	}
+	// The router serves the persisted article like one from the memory store
+	w := performRequest(newTestRouter(store), http.MethodGet, "/articles/1", "")
+	var fetched Article
+	decodeResponse(t, w, &fetched)
+	if w.Code != http.StatusOK || fetched.Title != "Persisted" || !slices.Equal(fetched.Tags, []string{"go", "gorm"}) {
+		t.Fatalf("GET /articles/1: status %d, article %+v", w.Code, fetched)
+	}
+}
+
+func TestGormArticleStoreLimit(t *testing.T) {
+	store := newTestGormStore(t, openTestDB(t), 2, nil)
+	article := Article{Title: "t", Content: "c", Author: "a"}
+
+	// A batch that doesn't fit is rejected as a whole
+	if _, err := store.Create(article, article, article); !errors.Is(err, ErrArticleLimit) {
+		t.Fatalf("Create of 3: error %v, want %v", err, ErrArticleLimit)
+	}
+	created, err := store.Create(article, article)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Soft-deleted articles still take up room
+	if _, err := store.Delete(created[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(article); !errors.Is(err, ErrArticleLimit) {
+		t.Fatalf("Create over the cap: error %v, want %v", err, ErrArticleLimit)
+	}
+}
+
+func TestGormArticleStoreLimitConcurrent(t *testing.T) {
+	const limit = 5
+	store := newTestGormStore(t, openTestDB(t), limit, nil)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var createdCount, limitedCount int
+	for i := 0; i < 2*limit; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.Create(Article{Title: "t", Content: "c", Author: "a"})
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err == nil:
+				createdCount++
+			case errors.Is(err, ErrArticleLimit):
+				limitedCount++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Creates racing for the last places can't both get one
+	if createdCount != limit || limitedCount != limit {
+		t.Fatalf("%d created and %d limited, want %d of each", createdCount, limitedCount, limit)
+	}
+	list, err := store.List(ArticleFilter{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != limit {
+		t.Fatalf("store has %d articles, want %d", len(list), limit)
+	}
+}
@@ -1,334 +1,2738 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"log/slog"
+	"math"
 	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"runtime/debug"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/time/rate"
 )
 
 // Models
 type Article struct {
-	ID        int       `json:"id"`
-	Title     string    `json:"title"`
-	Content   string    `json:"content"`
-	Author    string    `json:"author"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID        int        `json:"id" xml:"id"`
+	Title     string     `json:"title" xml:"title" binding:"article_title"`
+	Content   string     `json:"content" xml:"content" binding:"article_content"`
+	Author    string     `json:"author" xml:"author" binding:"article_author"`
+	Category  string     `json:"category,omitempty" xml:"category,omitempty" binding:"omitempty,article_category"`
+	Tags      []string   `json:"tags,omitempty" xml:"tags>tag,omitempty" binding:"article_tags,dive,article_tag"`
+	CreatedAt time.Time  `json:"created_at" xml:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" xml:"updated_at"`
+	Deleted   bool       `json:"deleted" xml:"deleted"`
+	DeletedAt *time.Time `json:"deleted_at,omitempty" xml:"deleted_at,omitempty"`
+	Version   int        `json:"version" xml:"version"`
 }
 
 type Response struct {
-	Success   bool        `json:"id"`
-	Data      interface{} `json:"data,omitempty"`
-	Message   string      `json:"message,omitempty"`
-	Error     string      `json:"error,omitempty"`
-	RequestID string      `json:"request_id,omitempty"`
+	XMLName   xml.Name     `json:"-" xml:"response"`
+	Success   bool         `json:"success" xml:"success"`
+	Data      interface{}  `json:"data,omitempty" xml:"data,omitempty"`
+	Message   string       `json:"message,omitempty" xml:"message,omitempty"`
+	Error     string       `json:"error,omitempty" xml:"error,omitempty"`
+	RequestID string       `json:"request_id,omitempty" xml:"request_id,omitempty"`
+	Meta      interface{}  `json:"meta,omitempty" xml:"meta,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty" xml:"errors>error,omitempty"`
+}
+
+// Encodes the response like the xml tags say, except that the errors element
+// is left out entirely when there are none. A plain "errors>error,omitempty"
+// tag still writes an empty <errors></errors>.
+func (r Response) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	// response has no MarshalXML method, so encoding it doesn't recurse
+	type response Response
+	type errorList struct {
+		Errors []FieldError `xml:"error"`
+	}
+	out := struct {
+		response
+		Errors *errorList `xml:"errors,omitempty"`
+	}{response: response(r)}
+	if len(r.Errors) > 0 {
+		out.Errors = &errorList{Errors: r.Errors}
+	}
+	start.Name = xml.Name{Local: "response"}
+	return e.EncodeElement(out, start)
+}
+
+// A single invalid field of a request body
+type FieldError struct {
+	Field   string `json:"field" xml:"field"`
+	Message string `json:"message" xml:"message"`
+}
+
+// Fields accepted by a partial article update; nil means "not provided"
+type ArticlePatch struct {
+	Title    *string   `json:"title"`
+	Content  *string   `json:"content"`
+	Author   *string   `json:"author"`
+	Category *string   `json:"category"`
+	Tags     *[]string `json:"tags"`
+}
+
+// Outcome of a single item in a batch request
+type BatchResult struct {
+	Index   int          `json:"index" xml:"index"`
+	Success bool         `json:"success" xml:"success"`
+	Data    interface{}  `json:"data,omitempty" xml:"data,omitempty"`
+	Error   string       `json:"error,omitempty" xml:"error,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty" xml:"errors>error,omitempty"`
+}
+
+// Body of DELETE /articles
+type BulkDeleteInput struct {
+	IDs []int `json:"ids" xml:"ids>id"`
+}
+
+// Outcome of a single id in a bulk delete
+type BulkDeleteResult struct {
+	ID      int    `json:"id" xml:"id"`
+	Deleted bool   `json:"deleted" xml:"deleted"`
+	Error   string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// A change to an article, as sent to stream subscribers
+type ArticleEvent struct {
+	Type    string  `json:"type"`
+	Article Article `json:"article"`
+}
+
+// Fans article events out to every subscriber. Each subscriber gets its own
+// buffered channel; events are dropped for subscribers that fall behind so a
+// slow client can never block a writer.
+type articleBroker struct {
+	mu          sync.Mutex
+	subscribers map[chan ArticleEvent]struct{}
+	closed      bool
+}
+
+func newArticleBroker() *articleBroker {
+	return &articleBroker{subscribers: make(map[chan ArticleEvent]struct{})}
+}
+
+func (b *articleBroker) subscribe() chan ArticleEvent {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan ArticleEvent, 16)
+	if b.closed {
+		close(ch)
+		return ch
+	}
+	b.subscribers[ch] = struct{}{}
+	return ch
+}
+
+func (b *articleBroker) unsubscribe(ch chan ArticleEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Sends event to every subscriber. A nil broker drops events, for stores
+// nobody listens to.
+func (b *articleBroker) publish(event ArticleEvent) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for ch := range b.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Closes every subscriber channel and refuses new subscribers
+func (b *articleBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subscribers {
+		delete(b.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Response recorded for an Idempotency-Key so a retried request gets it back unchanged
+type idempotentResult struct {
+	status    int
+	article   Article
+	expiresAt time.Time
+}
+
+// Remembers the outcome of requests sent with an Idempotency-Key for ttl.
+// createArticle also uses one to find recently created articles by content hash.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	results map[string]idempotentResult
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, results: make(map[string]idempotentResult)}
+}
+
+func (s *idempotencyStore) get(key string) (idempotentResult, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	result, ok := s.results[key]
+	if !ok {
+		return idempotentResult{}, false
+	}
+	if time.Now().After(result.expiresAt) {
+		delete(s.results, key)
+		return idempotentResult{}, false
+	}
+	return result, true
+}
+
+// Stores the result for key, dropping any expired entries on the way
+func (s *idempotencyStore) put(key string, status int, article Article) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, result := range s.results {
+		if now.After(result.expiresAt) {
+			delete(s.results, k)
+		}
+	}
+	s.results[key] = idempotentResult{status: status, article: article, expiresAt: now.Add(s.ttl)}
 }
 
 var (
-	articles = []Article{
-		{ID: 1, Title: "Getting Started with Go", Content: "Go is a programming language...", Author: "John Doe", CreatedAt: time.Now(), UpdatedAt: time.Now()},
-		{ID: 2, Title: "Web Development with Gin", Content: "Gin is a web framework...", Author: "Jane Smith", CreatedAt: time.Now(), UpdatedAt: time.Now()},
+	ErrArticleNotFound   = errors.New("article not found")
+	ErrArticleNotDeleted = errors.New("article is not deleted")
+	ErrVersionConflict   = errors.New("article was modified")
+	ErrArticleLimit      = errors.New("article limit reached")
+)
+
+// Selects the articles returned by ArticleStore.List; empty fields match everything
+type ArticleFilter struct {
+	Author         string
+	Query          string
+	Category       string
+	Tag            string
+	IncludeDeleted bool
+}
+
+// Persistence for articles. Implementations return ErrArticleNotFound for
+// unknown or soft-deleted ids and must be safe for concurrent use. They also
+// publish an ArticleEvent for every change, in the order the changes happen.
+type ArticleStore interface {
+	// Returns the matching articles in creation order
+	List(filter ArticleFilter) ([]Article, error)
+	Get(id int, includeDeleted bool) (Article, error)
+	// Assigns ids, timestamps and version 1, returning the stored articles
+	Create(articles ...Article) ([]Article, error)
+	// Calls fn with the current article and saves its changes, bumping UpdatedAt
+	// and Version. The read and write are atomic; an error from fn aborts the update.
+	Update(id int, fn func(a *Article) error) (Article, error)
+	// Soft-deletes the article so it can be restored later
+	Delete(id int) (Article, error)
+	// When any article was last created, changed, deleted or restored
+	LastModified() (time.Time, error)
+	// Soft-deletes every live article among ids in one step, returning the
+	// deleted articles; ids that don't match a live article are skipped
+	DeleteMany(ids []int) ([]Article, error)
+	Restore(id int) (Article, error)
+}
+
+// ArticleStore keeping articles in a slice guarded by a mutex. It holds at most
+// maxArticles articles, soft-deleted ones included; 0 means no limit.
+//
+// Every change is published to events while the mutex is still held, so
+// subscribers see changes in the order they were made.
+type MemoryArticleStore struct {
+	mu           sync.Mutex
+	articles     []Article
+	nextID       int
+	maxArticles  int
+	lastModified time.Time
+	events       *articleBroker
+}
+
+func NewMemoryArticleStore(seed []Article, maxArticles int, events *articleBroker) *MemoryArticleStore {
+	s := &MemoryArticleStore{
+		articles:     append([]Article(nil), seed...),
+		nextID:       1,
+		maxArticles:  maxArticles,
+		lastModified: time.Now(),
+		events:       events,
+	}
+	for _, a := range seed {
+		if a.ID >= s.nextID {
+			s.nextID = a.ID + 1
+		}
+	}
+	return s
+}
+
+// Index of the article with id, or -1; callers must hold s.mu
+func (s *MemoryArticleStore) find(id int, includeDeleted bool) int {
+	for i := range s.articles {
+		if s.articles[i].ID == id && (includeDeleted || !s.articles[i].Deleted) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s *MemoryArticleStore) List(filter ArticleFilter) ([]Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return filterArticles(s.articles, filter.Author, filter.Query, filter.Category, filter.Tag, filter.IncludeDeleted), nil
+}
+
+func (s *MemoryArticleStore) Get(id int, includeDeleted bool) (Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(id, includeDeleted)
+	if i == -1 {
+		return Article{}, ErrArticleNotFound
+	}
+	return s.articles[i], nil
+}
+
+func (s *MemoryArticleStore) Create(articles ...Article) ([]Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// A batch that doesn't fit is rejected as a whole
+	if s.maxArticles > 0 && len(s.articles)+len(articles) > s.maxArticles {
+		return nil, ErrArticleLimit
+	}
+
+	now := time.Now()
+	created := make([]Article, len(articles))
+	for i, a := range articles {
+		a.Tags = slices.Clone(a.Tags)
+		a.ID = s.nextID
+		s.nextID++
+		a.CreatedAt = now
+		a.UpdatedAt = now
+		a.Deleted = false
+		a.DeletedAt = nil
+		a.Version = 1
+		s.articles = append(s.articles, a)
+		created[i] = a
+		s.events.publish(ArticleEvent{Type: "created", Article: a})
+	}
+	if len(articles) > 0 {
+		s.lastModified = now
+	}
+	return created, nil
+}
+
+func (s *MemoryArticleStore) Update(id int, fn func(a *Article) error) (Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(id, false)
+	if i == -1 {
+		return Article{}, ErrArticleNotFound
+	}
+	// fn works on a copy so a failed update leaves the stored article untouched
+	updated := s.articles[i]
+	updated.Tags = slices.Clone(updated.Tags)
+	if err := fn(&updated); err != nil {
+		return Article{}, err
+	}
+	updated.ID = id
+	updated.UpdatedAt = time.Now()
+	updated.Version = s.articles[i].Version + 1
+	s.articles[i] = updated
+	s.lastModified = updated.UpdatedAt
+	s.events.publish(ArticleEvent{Type: "updated", Article: updated})
+	return updated, nil
+}
+
+func (s *MemoryArticleStore) Delete(id int) (Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(id, false)
+	if i == -1 {
+		return Article{}, ErrArticleNotFound
+	}
+	now := time.Now()
+	s.articles[i].Deleted = true
+	s.articles[i].DeletedAt = &now
+	s.lastModified = now
+	s.events.publish(ArticleEvent{Type: "deleted", Article: s.articles[i]})
+	return s.articles[i], nil
+}
+
+func (s *MemoryArticleStore) LastModified() (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.lastModified, nil
+}
+
+func (s *MemoryArticleStore) DeleteMany(ids []int) ([]Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	deleted := make([]Article, 0, len(ids))
+	for _, id := range ids {
+		i := s.find(id, false)
+		if i == -1 {
+			continue
+		}
+		s.articles[i].Deleted = true
+		s.articles[i].DeletedAt = &now
+		deleted = append(deleted, s.articles[i])
+		s.events.publish(ArticleEvent{Type: "deleted", Article: s.articles[i]})
+	}
+	if len(deleted) > 0 {
+		s.lastModified = now
+	}
+	return deleted, nil
+}
+
+func (s *MemoryArticleStore) Restore(id int) (Article, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i := s.find(id, true)
+	if i == -1 {
+		return Article{}, ErrArticleNotFound
 	}
-	nextId     = 3
-	articleMux sync.Mutex
+	if !s.articles[i].Deleted {
+		return Article{}, ErrArticleNotDeleted
+	}
+	s.articles[i].Deleted = false
+	s.articles[i].DeletedAt = nil
+	s.articles[i].UpdatedAt = time.Now()
+	s.lastModified = s.articles[i].UpdatedAt
+	s.events.publish(ArticleEvent{Type: "restored", Article: s.articles[i]})
+	return s.articles[i], nil
+}
+
+// Pagination details returned alongside a page of results
+type PageMeta struct {
+	Total      int `json:"total" xml:"total"`
+	Page       int `json:"page" xml:"page"`
+	TotalPages int `json:"total_pages" xml:"total_pages"`
+	Limit      int `json:"limit" xml:"limit"`
+}
+
+// Articles the server starts with
+var seedArticles = []Article{
+	{ID: 1, Title: "Getting Started with Go", Content: "Go is a programming language...", Author: "John Doe", Category: "tutorial", Tags: []string{"go"}, CreatedAt: time.Now(), UpdatedAt: time.Now(), Version: 1},
+	{ID: 2, Title: "Web Development with Gin", Content: "Gin is a web framework...", Author: "Jane Smith", Category: "tutorial", Tags: []string{"go", "gin"}, CreatedAt: time.Now(), UpdatedAt: time.Now(), Version: 1},
+}
+
+var (
+	startTime time.Time
+
+	// The article store publishes changes here for the stream endpoints
+	articleEvents = newArticleBroker()
+
+	// Articles created with an Idempotency-Key, so retries don't create duplicates.
+	// idempotentCreateMux is held from the lookup to the put so concurrent retries
+	// with the same key can't both create an article
+	createdArticles     = newIdempotencyStore(idempotencyTTL)
+	idempotentCreateMux sync.Mutex
+
+	// Number of requests the server has received since it started
+	requestCount atomic.Int64
 )
 
-// Main program
-func main() {
+// Build information, set at build time with
+// go build -ldflags "-X main.version=1.2.0 -X main.gitCommit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	gitCommit = "dev"
+	buildTime = "dev"
+)
+
+// Orderings accepted by the sort query parameter; a leading "-" means descending
+var articleSorts = map[string]func(a, b Article) bool{
+	"created_at":  func(a, b Article) bool { return a.CreatedAt.Before(b.CreatedAt) },
+	"-created_at": func(a, b Article) bool { return a.CreatedAt.After(b.CreatedAt) },
+	"title":       func(a, b Article) bool { return a.Title < b.Title },
+	"-title":      func(a, b Article) bool { return a.Title > b.Title },
+}
+
+// Categories an article may be filed under; an empty category means uncategorized
+var articleCategories = []string{"news", "tutorial", "opinion", "review"}
+
+var errUnknownCategory = errors.New("category must be one of " + strings.Join(articleCategories, ", "))
+
+// Upgrades /ws/articles requests; only same-origin browsers are accepted by default
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+const (
+	shutdownTimeout  = 10 * time.Second
+	requestTimeout   = 5 * time.Second
+	gzipMinSize      = 1024
+	defaultCSP       = "default-src 'none'; frame-ancestors 'none'"
+	maxBodyBytes     = 1 << 20
+	defaultPageLimit = 10
+	maxPageLimit     = 100
+	idempotencyTTL   = 24 * time.Hour
+
+	maxRequestIDLength = 128
+
+	// Longest article fields accepted, counted in characters, and the most tags
+	// an article can have. The article_* validation aliases are built from these
+	maxTitleLength   = 200
+	maxAuthorLength  = 100
+	maxContentLength = 50000
+	maxTags          = 20
+	maxTagLength     = 50
+
+	// Cap on articles held by the store unless MAX_ARTICLES is set
+	defaultMaxArticles = 100000
+)
+
+// What newRouter needs besides the handlers; main fills it in from the environment
+type routerConfig struct {
+	store       ArticleStore
+	keys        *MemoryKeyStore
+	jwtSecret   []byte
+	dedupWindow time.Duration
+	logOutput   io.Writer
+	jsonLogs    bool
+	corsOrigins []string
+	rateLimits  map[string]RateLimitTier
+}
+
+// Builds the engine with every middleware and route the server uses
+func newRouter(cfg routerConfig) *gin.Engine {
 	r := gin.New()
+	// Wrong methods on known paths get a 405 with an Allow header instead of a 404
+	r.HandleMethodNotAllowed = true
+	r.NoMethod(methodNotAllowed)
+	r.NoRoute(notFound)
 	r.Use(
-		ErrorHandlerMiddleware(),
-		RequestIDMiddleware(),
-		LoggingMiddleware(),
-		CORSMiddleware(),
-		RateLimitMiddleware(),
+		ErrorHandlerMiddleware(cfg.logOutput),
+		RequestIDMiddleware(newHandlerLogger(cfg.logOutput, cfg.jsonLogs)),
+		RequestCountMiddleware(),
+		MetricsMiddleware(),
+		LoggingMiddleware(cfg.logOutput, cfg.jsonLogs),
+		CORSMiddleware(cfg.corsOrigins),
+		SecurityHeadersMiddleware(defaultCSP),
 		ContentTypeMiddleware(),
+		BodySizeLimitMiddleware(maxBodyBytes),
+		GzipMiddleware(gzipMinSize),
+		// Auth failures and unknown routes never reach the per-role limits below
+		FailedRequestLimitMiddleware(cfg.rateLimits[anonymousRole], 10*time.Minute, time.Minute, "/healthz", "/version", "/metrics", "/openapi.json"),
+		// Streams stay open for as long as the client listens, so they get no deadline
+		TimeoutMiddleware(requestTimeout, "/articles/stream", "/ws/articles"),
 	)
+	// Health checks, metrics, build info and the API spec sit outside both groups so they are never rate limited or authenticated
+	r.GET("/healthz", healthz)
+	r.GET("/version", getVersion)
+	r.GET("/metrics", gin.WrapH(promhttp.HandlerFor(metricsRegistry, promhttp.HandlerOpts{})))
+	r.GET("/openapi.json", getOpenAPISpec)
+
+	store, keyStore := cfg.store, cfg.keys
+	auth := AuthMiddleware(keyStore)
+	// With a JWT secret every route also accepts Bearer tokens
+	if cfg.jwtSecret != nil {
+		auth = BearerOrAPIKeyMiddleware(JWTAuthMiddleware(cfg.jwtSecret), auth)
+	}
+
+	// One limiter shared by both groups so a client's budget is tracked in one place
+	rateLimiter := RateLimitMiddleware(cfg.rateLimits, 10*time.Minute, time.Minute)
+
 	// public routes
 	public := r.Group("/")
+	public.Use(OptionalAuthMiddleware(keyStore, cfg.jwtSecret), rateLimiter)
 	{
 		public.GET("/ping", ping)
-		public.GET("/articles", getArticles)
-		public.GET("/articles/:id", getArticleById)
+		public.GET("/articles", getArticles(store))
+		public.GET("/articles/stream", streamArticles)
+		public.GET("/ws/articles", articlesWebSocket)
+		public.GET("/articles/:id", getArticleById(store))
+		public.HEAD("/articles/:id", headArticle(store))
+	}
+
+	//protected routes
+	protected := r.Group("/")
+	protected.Use(auth, rateLimiter)
+	{
+		protected.POST("/articles", createArticle(store, cfg.dedupWindow))
+		protected.POST("/articles/batch", createArticlesBatch(store))
+		protected.PUT("/articles/:id", updateArticle(store))
+		protected.PATCH("/articles/:id", patchArticle(store))
+		protected.DELETE("/articles/:id", deleteArticle(store))
+		protected.DELETE("/articles", RequireRole("admin"), deleteArticles(store))
+		protected.GET("/admin/stats", RequireRole("admin"), getStats(store))
+		protected.POST("/admin/articles/:id/restore", RequireRole("admin"), restoreArticle(store))
+		protected.POST("/admin/keys", RequireRole("admin"), addAPIKey(keyStore))
+		protected.DELETE("/admin/keys/:key", RequireRole("admin"), removeAPIKey(keyStore))
+	}
+	return r
+}
+
+// Main program
+func main() {
+	startTime = time.Now()
+
+	// Articles live in memory unless ARTICLES_DSN points at a Postgres database
+	maxArticles, err := maxArticlesFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	dedupWindow, err := dedupWindowFromEnv()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var store ArticleStore = NewMemoryArticleStore(seedArticles, maxArticles, articleEvents)
+	if dsn := os.Getenv("ARTICLES_DSN"); dsn != "" {
+		gormStore, err := OpenGormArticleStore(dsn, maxArticles, articleEvents)
+		if err != nil {
+			log.Fatalf("failed to open article database: %v", err)
+		}
+		store = gormStore
+	}
+	// Setting JWT_SECRET lets every route also accept Bearer tokens
+	var jwtSecret []byte
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		jwtSecret = []byte(secret)
+	}
+
+	r := newRouter(routerConfig{
+		store:       store,
+		keys:        NewMemoryKeyStore(defaultAPIKeys),
+		jwtSecret:   jwtSecret,
+		dedupWindow: dedupWindow,
+		logOutput:   os.Stdout,
+		jsonLogs:    os.Getenv("LOG_FORMAT") == "json",
+		corsOrigins: corsOriginsFromEnv(),
+		rateLimits:  defaultRateLimitTiers,
+	})
+
+	srv := &http.Server{
+		Addr:    ":8080",
+		Handler: r,
+	}
+	// Ending the event streams lets Shutdown finish instead of waiting on them
+	srv.RegisterOnShutdown(articleEvents.close)
+
+	go func() {
+		log.Println("Server running on :8080")
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatalf("server error: %v", err)
+		}
+	}()
+
+	// Wait for an interrupt, then give in-flight requests time to finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Println("Shutting down server...")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("server forced to shut down: %v", err)
+	}
+	log.Println("Server stopped")
+}
+
+// essential middlewares
+
+// Turns panics into a 500 response. The panic and its stack trace are logged
+// to out; the client only gets a generic error.
+func ErrorHandlerMiddleware(out io.Writer) gin.HandlerFunc {
+	logger := log.New(out, "", log.LstdFlags)
+	return func(c *gin.Context) {
+		defer func() {
+			recovered := recover()
+			if recovered == nil {
+				return
+			}
+			stack := debug.Stack()
+			if p, ok := recovered.(handlerPanic); ok {
+				recovered, stack = p.value, p.stack
+			}
+			// net/http uses this panic to abort a response on purpose
+			if recovered == http.ErrAbortHandler {
+				panic(recovered)
+			}
+			logger.Printf(
+				"[%s] panic recovered on %s %s: %v\n%s",
+				c.GetString("request_id"),
+				c.Request.Method,
+				c.Request.URL.Path,
+				recovered,
+				stack,
+			)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
+				Success:   false,
+				Error:     "interal server error",
+				RequestID: c.GetString("request_id"),
+			})
+		}()
+		c.Next()
+	}
+}
+
+// Tags each request with an id, reusing a valid X-Request-ID sent by the client
+// or an upstream proxy so the request can be traced across services. Handlers log
+// through Logger(c), which writes to logger with the id attached.
+func RequestIDMiddleware(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if !validRequestID(id) {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Set("logger", logger.With("request_id", id))
+		c.Writer.Header().Set("X-Request-ID", id)
+		c.Next()
+	}
+}
+
+// Incoming ids end up in logs and headers, so only short ids made of
+// letters, digits and a few separators are trusted
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Builds the logger handed to RequestIDMiddleware, writing to out in the same
+// format as the request log
+func newHandlerLogger(out io.Writer, jsonFormat bool) *slog.Logger {
+	if jsonFormat {
+		return slog.New(slog.NewJSONHandler(out, nil))
+	}
+	return slog.New(slog.NewTextHandler(out, nil))
+}
+
+// Returns the logger for this request, which tags every line with its request_id.
+// Falls back to the default logger when RequestIDMiddleware did not run.
+func Logger(c *gin.Context) *slog.Logger {
+	if logger, ok := c.Get("logger"); ok {
+		return logger.(*slog.Logger)
+	}
+	return slog.Default()
+}
+
+func RequestCountMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestCount.Add(1)
+		c.Next()
+	}
+}
+
+// One request as written by LoggingMiddleware in JSON mode
+type requestLog struct {
+	RequestID  string  `json:"request_id"`
+	Method     string  `json:"method"`
+	Path       string  `json:"path"`
+	Status     int     `json:"status"`
+	DurationMS float64 `json:"duration_ms"`
+	ClientIP   string  `json:"client_ip"`
+	UserAgent  string  `json:"user_agent"`
+}
+
+// Logs every request to out once it completes. With jsonFormat set each request
+// is written as a single JSON object per line instead of the plain text format.
+func LoggingMiddleware(out io.Writer, jsonFormat bool) gin.HandlerFunc {
+	// The logger serializes writes to out; JSON lines carry their own fields, so they get no prefix
+	logger := log.New(out, "", log.LstdFlags)
+	if jsonFormat {
+		logger.SetFlags(0)
+	}
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		reqID := c.GetString("request_id")
+		duration := time.Since(start)
+
+		if jsonFormat {
+			line, err := json.Marshal(requestLog{
+				RequestID:  reqID,
+				Method:     c.Request.Method,
+				Path:       c.Request.URL.Path,
+				Status:     c.Writer.Status(),
+				DurationMS: float64(duration) / float64(time.Millisecond),
+				ClientIP:   c.ClientIP(),
+				UserAgent:  c.Request.UserAgent(),
+			})
+			if err != nil {
+				logger.Printf("failed to encode request log: %v", err)
+				return
+			}
+			logger.Print(string(line))
+			return
+		}
+
+		logger.Printf(
+			"[%s] %s %s %d %s %s %s",
+			reqID,
+			c.Request.Method,
+			c.Request.URL.Path,
+			c.Writer.Status(),
+			duration,
+			c.ClientIP(),
+			c.Request.UserAgent(),
+		)
+	}
+}
+
+// Resolves an API key to the role it grants
+type KeyStore interface {
+	Lookup(key string) (role string, ok bool)
+}
+
+// KeyStore backed by an in-memory map of API keys to roles. Keys can be added
+// and removed while the server is running.
+type MemoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string]string
+}
+
+func NewMemoryKeyStore(keys map[string]string) *MemoryKeyStore {
+	copied := make(map[string]string, len(keys))
+	for k, role := range keys {
+		copied[k] = role
+	}
+	return &MemoryKeyStore{keys: copied}
+}
+
+func (s *MemoryKeyStore) Lookup(key string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	role, ok := s.keys[key]
+	return role, ok
+}
+
+// Adds key with the given role, reporting false if the key already exists
+func (s *MemoryKeyStore) AddKey(key, role string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.keys[key]; exists {
+		return false
+	}
+	s.keys[key] = role
+	return true
+}
+
+var (
+	ErrAPIKeyNotFound = errors.New("API key not found")
+	ErrLastAdminKey   = errors.New("cannot remove the last admin API key")
+)
+
+// Removes key. The last admin key can't be removed, since nobody could manage
+// keys afterwards.
+func (s *MemoryKeyStore) RemoveKey(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	role, exists := s.keys[key]
+	if !exists {
+		return ErrAPIKeyNotFound
+	}
+	if role == "admin" {
+		admins := 0
+		for _, r := range s.keys {
+			if r == "admin" {
+				admins++
+			}
+		}
+		if admins == 1 {
+			return ErrLastAdminKey
+		}
+	}
+	delete(s.keys, key)
+	return nil
+}
+
+// Roles that can be granted to an API key
+var apiKeyRoles = map[string]bool{"admin": true, "user": true}
+
+// Body of POST /admin/keys; a key is generated when none is given
+type APIKeyInput struct {
+	Key  string `json:"key" xml:"key"`
+	Role string `json:"role" xml:"role"`
+}
+
+var defaultAPIKeys = map[string]string{
+	"admin-key":    "admin",
+	"user-key-456": "user",
+}
+
+// Short, non-secret identifier for an API key, safe to log or compare
+func keyFingerprint(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Like AuthMiddleware, but lets requests without valid credentials through
+// anonymously. When jwtSecret is set a Bearer token is tried first, the same
+// way BearerOrAPIKeyMiddleware does, before falling back to X-API-Key.
+func OptionalAuthMiddleware(store KeyStore, jwtSecret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if header := c.GetHeader("Authorization"); header != "" && jwtSecret != nil {
+			if claims, err := parseBearerToken(jwtSecret, header); err == nil {
+				setJWTPrincipal(c, claims)
+				c.Next()
+				return
+			}
+		}
+		key := c.GetHeader("X-API-Key")
+		if role, ok := store.Lookup(key); ok {
+			setKeyPrincipal(c, key, role)
+		}
+		c.Next()
+	}
+}
+
+// Records who made the request. The principal tells callers sharing a role
+// apart, e.g. for scoping idempotency keys.
+func setKeyPrincipal(c *gin.Context, key, role string) {
+	c.Set("role", role)
+	c.Set("principal", "key:"+keyFingerprint(key))
+}
+
+func setJWTPrincipal(c *gin.Context, claims jwtClaims) {
+	c.Set("role", claims.Role)
+	c.Set("principal", "jwt:"+claims.Subject)
+}
+
+func AuthMiddleware(store KeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("X-API-Key")
+		role, ok := store.Lookup(key)
+		if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+				Success:   false,
+				Error:     "invalid or missing API key",
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+		setKeyPrincipal(c, key, role)
+		c.Next()
+	}
+}
+
+// Only lets the request through when AuthMiddleware assigned one of the given roles
+func RequireRole(roles ...string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		allowed[role] = true
+	}
+
+	return func(c *gin.Context) {
+		if !allowed[c.GetString("role")] {
+			c.AbortWithStatusJSON(http.StatusForbidden, Response{
+				Success:   false,
+				Error:     "insufficient permissions",
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+		c.Next()
+	}
+}
+
+// Claims carried by the JWTs JWTAuthMiddleware accepts
+type jwtClaims struct {
+	Role string `json:"role"`
+	jwt.RegisteredClaims
+}
+
+// Authenticates requests with an HS256 signed Bearer token, setting the token's
+// role claim on the context like AuthMiddleware does. Tokens must carry an expiry.
+func JWTAuthMiddleware(secret []byte) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := parseBearerToken(secret, c.GetHeader("Authorization"))
+		if err != nil {
+			message := "invalid token"
+			switch {
+			case errors.Is(err, errMissingBearer):
+				message = "missing bearer token"
+			case errors.Is(err, jwt.ErrTokenExpired):
+				message = "token has expired"
+			}
+			c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+				Success:   false,
+				Error:     message,
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+		setJWTPrincipal(c, claims)
+		c.Next()
+	}
+}
+
+var errMissingBearer = errors.New("missing bearer token")
+
+// Validates the token in an Authorization header value. Tokens without a role
+// claim are rejected like any other invalid token.
+func parseBearerToken(secret []byte, header string) (jwtClaims, error) {
+	tokenString, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok {
+		return jwtClaims{}, errMissingBearer
+	}
+
+	var claims jwtClaims
+	_, err := jwt.ParseWithClaims(strings.TrimSpace(tokenString), &claims, func(*jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithExpirationRequired())
+	if err != nil {
+		return jwtClaims{}, err
+	}
+	if claims.Role == "" {
+		return jwtClaims{}, jwt.ErrTokenInvalidClaims
+	}
+	return claims, nil
+}
+
+// Mints a token JWTAuthMiddleware accepts, for the given subject and role, valid for ttl
+func NewJWT(secret []byte, subject, role string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	claims := jwtClaims{
+		Role: role,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		},
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(secret)
+}
+
+// Uses bearer for requests with an Authorization header and apiKey for the rest,
+// so clients can authenticate with either a JWT or an API key
+func BearerOrAPIKeyMiddleware(bearer, apiKey gin.HandlerFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetHeader("Authorization") != "" {
+			bearer(c)
+			return
+		}
+		apiKey(c)
+	}
+}
+
+var defaultAllowedOrigins = []string{
+	"http://localhost:3000",
+	"https://myblog.com",
+}
+
+// Allows cross-origin requests from allowedOrigins, or from the defaults when
+// none are given. A "*" entry echoes back any origin.
+//
+// Preflights advertise the methods registered for the requested path. No route
+// handles OPTIONS, so with HandleMethodNotAllowed set gin has already listed
+// those methods in the Allow header by the time this middleware runs.
+func CORSMiddleware(allowedOrigins []string) gin.HandlerFunc {
+	if len(allowedOrigins) == 0 {
+		allowedOrigins = defaultAllowedOrigins
+	}
+	allowed := make(map[string]bool, len(allowedOrigins))
+	for _, origin := range allowedOrigins {
+		allowed[origin] = true
+	}
+	allowAny := allowed["*"]
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin != "" && (allowAny || allowed[origin]) {
+			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+			c.Writer.Header().Add("Vary", "Origin")
+		}
+		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-type, Authorization, X-API-Key, X-Request-ID, Idempotency-Key, If-Match, If-None-Match")
+		// Lets browser clients read the rate limit headers to back off correctly
+		c.Writer.Header().Set("Access-Control-Expose-Headers", "X-Request-ID, X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After")
+
+		if c.Request.Method == http.MethodOptions {
+			// Without an Allow header the path doesn't exist, so the request falls through to the 404
+			if allow := c.Writer.Header().Get("Allow"); allow != "" {
+				allow += ", " + http.MethodOptions
+				c.Header("Allow", allow)
+				c.Header("Access-Control-Allow-Methods", allow)
+				c.AbortWithStatus(http.StatusNoContent)
+				return
+			}
+		}
+
+		c.Next()
+	}
+}
+
+// A rate limiter together with the last time its client was seen
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Token bucket settings applied to every client of a role
+type RateLimitTier struct {
+	RPS   rate.Limit
+	Burst int
+}
+
+const anonymousRole = "anonymous"
+
+var defaultRateLimitTiers = map[string]RateLimitTier{
+	anonymousRole: {RPS: rate.Every(time.Minute / 60), Burst: 60},
+	"user":        {RPS: rate.Every(time.Minute / 100), Burst: 100},
+	"admin":       {RPS: rate.Every(time.Minute / 300), Burst: 300},
+}
+
+// Returns the limiter of each client key, creating it from the tier on first use.
+// Clients idle for longer than idleTimeout are forgotten; idle entries are swept
+// every sweepInterval.
+func newVisitorLimiters(idleTimeout, sweepInterval time.Duration) func(key string, tier RateLimitTier) *rate.Limiter {
+	var visitors = make(map[string]*visitor)
+	var mu sync.Mutex
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			mu.Lock()
+			for key, v := range visitors {
+				if time.Since(v.lastSeen) > idleTimeout {
+					delete(visitors, key)
+				}
+			}
+			mu.Unlock()
+		}
+	}()
+
+	return func(key string, tier RateLimitTier) *rate.Limiter {
+		mu.Lock()
+		defer mu.Unlock()
+
+		v, exists := visitors[key]
+		if !exists {
+			v = &visitor{limiter: rate.NewLimiter(tier.RPS, tier.Burst)}
+			visitors[key] = v
+		}
+		v.lastSeen = time.Now()
+		return v.limiter
+	}
+}
+
+// Limits each client IP using the tier of its role, forgetting clients idle for
+// longer than idleTimeout. Idle entries are swept every sweepInterval.
+//
+// The role is read from the context, so AuthMiddleware must run before this
+// middleware for role based limits to apply; otherwise every request is
+// treated as anonymous. Roles without a tier fall back to the anonymous tier.
+func RateLimitMiddleware(tiers map[string]RateLimitTier, idleTimeout, sweepInterval time.Duration) gin.HandlerFunc {
+	getLimiter := newVisitorLimiters(idleTimeout, sweepInterval)
+
+	return func(c *gin.Context) {
+		role := c.GetString("role")
+		tier, ok := tiers[role]
+		if !ok {
+			role = anonymousRole
+			tier = tiers[anonymousRole]
+		}
+		limiter := getLimiter(role+"|"+c.ClientIP(), tier)
+
+		// Reserving instead of Allow tells us how long the client would have to wait
+		now := time.Now()
+		reservation := limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		if delay > 0 {
+			// The request is rejected, so the token it reserved is handed back
+			reservation.CancelAt(now)
+		}
+
+		setRateLimitHeaders(c, limiter, tier, now)
+		if delay > 0 {
+			abortRateLimited(c, delay)
+			return
+		}
+		c.Next()
+	}
+}
+
+// Limits each client IP on the requests that fail before reaching
+// RateLimitMiddleware: 401s from AuthMiddleware and 404s and 405s for
+// unknown routes. Every such failure takes a token from the IP's bucket, and
+// once it is empty all requests from the IP get a 429 until it refills, so
+// API keys can't be guessed at full speed. Requests that succeed cost nothing
+// here; the per-role limits cover them. Routes listed in skipRoutes are never
+// limited.
+func FailedRequestLimitMiddleware(tier RateLimitTier, idleTimeout, sweepInterval time.Duration, skipRoutes ...string) gin.HandlerFunc {
+	getLimiter := newVisitorLimiters(idleTimeout, sweepInterval)
+	skip := make(map[string]bool, len(skipRoutes))
+	for _, route := range skipRoutes {
+		skip[route] = true
+	}
+
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			c.Next()
+			return
+		}
+		limiter := getLimiter(c.ClientIP(), tier)
+
+		// Only looks at the bucket; the request is charged once it has failed
+		now := time.Now()
+		reservation := limiter.ReserveN(now, 1)
+		delay := reservation.DelayFrom(now)
+		reservation.CancelAt(now)
+		if delay > 0 {
+			setRateLimitHeaders(c, limiter, tier, now)
+			abortRateLimited(c, delay)
+			return
+		}
+
+		c.Next()
+
+		switch c.Writer.Status() {
+		case http.StatusUnauthorized, http.StatusNotFound, http.StatusMethodNotAllowed:
+			limiter.Allow()
+		}
+	}
+}
+
+// Sets the X-RateLimit headers describing limiter's bucket at now
+func setRateLimitHeaders(c *gin.Context, limiter *rate.Limiter, tier RateLimitTier, now time.Time) {
+	tokens := limiter.TokensAt(now)
+	remaining := int(math.Max(0, math.Floor(tokens)))
+	// Reset is when the bucket is full again
+	reset := now
+	if tier.RPS > 0 && tokens < float64(tier.Burst) {
+		reset = now.Add(time.Duration((float64(tier.Burst) - tokens) / float64(tier.RPS) * float64(time.Second)))
+	}
+	c.Header("X-RateLimit-Limit", strconv.Itoa(tier.Burst))
+	c.Header("X-RateLimit-Remaining", strconv.Itoa(remaining))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(int64(math.Ceil(float64(reset.UnixNano())/float64(time.Second))), 10))
+}
+
+// Rejects the request with a 429, telling the client to retry after delay
+func abortRateLimited(c *gin.Context, delay time.Duration) {
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, Response{
+		Success:   false,
+		Error:     "too many requests, limit exceeded",
+		RequestID: c.GetString("request_id"),
+	})
+}
+
+// Content types that are already compressed or must be streamed as-is
+var uncompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"text/event-stream",
+}
+
+// Holds back the response until minSize bytes have been written, then either
+// switches to gzip or passes the body through untouched
+type gzipWriter struct {
+	gin.ResponseWriter
+	minSize int
+	status  int
+	buf     bytes.Buffer
+	gz      *gzip.Writer
+	decided bool
+}
+
+func (w *gzipWriter) WriteHeader(code int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(code)
+		return
+	}
+	w.status = code
+}
+
+func (w *gzipWriter) WriteHeaderNow() {
+	if w.decided {
+		w.ResponseWriter.WriteHeaderNow()
+	}
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	if w.decided {
+		if w.gz != nil {
+			return w.gz.Write(data)
+		}
+		return w.ResponseWriter.Write(data)
+	}
+	w.buf.Write(data)
+	if w.buf.Len() >= w.minSize {
+		if err := w.decide(w.compressible()); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (w *gzipWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+func (w *gzipWriter) Status() int {
+	if w.decided {
+		return w.ResponseWriter.Status()
+	}
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *gzipWriter) Written() bool {
+	return w.decided && w.ResponseWriter.Written()
+}
+
+func (w *gzipWriter) Flush() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	w.ResponseWriter.Flush()
+}
+
+func (w *gzipWriter) compressible() bool {
+	header := w.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	contentType := header.Get("Content-Type")
+	for _, prefix := range uncompressibleTypes {
+		if strings.HasPrefix(contentType, prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+// Sends the headers and anything buffered so far, compressed or not
+func (w *gzipWriter) decide(compress bool) error {
+	w.decided = true
+	if compress {
+		header := w.Header()
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	if w.buf.Len() == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(w.buf.Bytes())
+	} else {
+		_, err = w.ResponseWriter.Write(w.buf.Bytes())
+	}
+	w.buf.Reset()
+	return err
+}
+
+// Responses that never reached minSize go out uncompressed
+func (w *gzipWriter) close() {
+	if !w.decided {
+		w.decide(false)
+	}
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
+
+// Compresses responses of at least minSize bytes for clients that accept gzip
+func GzipMiddleware(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Any response may differ by Accept-Encoding, compressed or not, so caches
+		// must not hand an uncompressed one to a client asking for gzip or vice versa
+		c.Writer.Header().Add("Vary", "Accept-Encoding")
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		gw := &gzipWriter{ResponseWriter: c.Writer, minSize: minSize}
+		c.Writer = gw
+		defer func() {
+			gw.close()
+			c.Writer = gw.ResponseWriter
+		}()
+		c.Next()
+	}
+}
+
+// Reports whether an Accept-Encoding header allows gzip. Codings are matched
+// case-insensitively and a q=0 weight refuses one; an explicit gzip entry
+// takes precedence over "*".
+func acceptsGzip(header string) bool {
+	gzipQ, anyQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(strings.TrimSpace(name), "q") {
+				parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil {
+					parsed = 0
+				}
+				q = parsed
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQ = q
+		case "*":
+			anyQ = q
+		}
+	}
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return anyQ > 0
+}
+
+// Buffers a handler's response so TimeoutMiddleware can throw it away once
+// the deadline has passed and a 503 has already been sent
+type timeoutWriter struct {
+	gin.ResponseWriter
+	mu       sync.Mutex
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	wrote    bool
+	timedOut bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut || w.wrote {
+		return
+	}
+	w.status = code
+}
+
+func (w *timeoutWriter) WriteHeaderNow() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.wrote = true
+}
+
+func (w *timeoutWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.wrote = true
+	return w.body.Write(data)
+}
+
+func (w *timeoutWriter) WriteString(data string) (int, error) {
+	return w.Write([]byte(data))
+}
+
+func (w *timeoutWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+func (w *timeoutWriter) Written() bool {
+	return w.wrote
+}
+
+func (w *timeoutWriter) Size() int {
+	if !w.wrote {
+		return -1
+	}
+	return w.body.Len()
+}
+
+// Buffered output is sent in one go once the handler finishes
+func (w *timeoutWriter) Flush() {}
+
+// Copies the buffered response to the real writer
+func (w *timeoutWriter) flushTo(dst gin.ResponseWriter) {
+	header := dst.Header()
+	for k := range header {
+		delete(header, k)
+	}
+	for k, v := range w.header {
+		header[k] = v
+	}
+	if w.status != 0 {
+		dst.WriteHeader(w.status)
+	}
+	if w.wrote {
+		dst.WriteHeaderNow()
+	}
+	if w.body.Len() > 0 {
+		dst.Write(w.body.Bytes())
+	}
+}
+
+// A panic from a handler run by TimeoutMiddleware, re-raised on the request
+// goroutine together with the stack of the goroutine that panicked
+type handlerPanic struct {
+	value interface{}
+	stack []byte
+}
+
+// Gives each request a deadline of d. Handlers see it through the request
+// context; if the chain is still running when it expires the client gets a
+// 503 straight away and anything the handler writes afterwards is discarded.
+// Routes listed in skipRoutes are left without a deadline.
+func TimeoutMiddleware(d time.Duration, skipRoutes ...string) gin.HandlerFunc {
+	skip := make(map[string]bool, len(skipRoutes))
+	for _, route := range skipRoutes {
+		skip[route] = true
+	}
+
+	return func(c *gin.Context) {
+		if skip[c.FullPath()] {
+			c.Next()
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), d)
+		defer cancel()
+		c.Request = c.Request.WithContext(ctx)
+
+		w := c.Writer
+		tw := &timeoutWriter{ResponseWriter: w, header: w.Header().Clone()}
+		c.Writer = tw
+
+		done := make(chan struct{})
+		var panicked interface{}
+		// Whether the chain only returned once the deadline had passed
+		var late bool
+		go func() {
+			defer close(done)
+			defer func() {
+				// The stack is taken here since it is lost once the panic is re-raised below
+				if p := recover(); p != nil {
+					panicked = handlerPanic{value: p, stack: debug.Stack()}
+				}
+			}()
+			c.Next()
+			late = errors.Is(ctx.Err(), context.DeadlineExceeded)
+		}()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+		tw.mu.Lock()
+		select {
+		case <-done:
+			// A handler watching the context can return right as it expires;
+			// what it wrote after the deadline is still thrown away
+			tw.timedOut = late
+		default:
+			tw.timedOut = true
+		}
+		tw.mu.Unlock()
+
+		if tw.timedOut {
+			body, _ := json.Marshal(Response{
+				Success:   false,
+				Error:     "request timed out",
+				RequestID: c.GetString("request_id"),
+			})
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write(body)
+			w.Flush()
+		}
+		// The handler still owns the context until it returns
+		<-done
+
+		c.Writer = w
+		if panicked != nil {
+			panic(panicked)
+		}
+		if !tw.timedOut {
+			tw.flushTo(w)
+		}
+	}
+}
+
+// Reads a comma separated origin list from CORS_ALLOWED_ORIGINS
+func corsOriginsFromEnv() []string {
+	var origins []string
+	for _, origin := range strings.Split(os.Getenv("CORS_ALLOWED_ORIGINS"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// Reads the article cap from MAX_ARTICLES, defaulting to defaultMaxArticles
+func maxArticlesFromEnv() (int, error) {
+	value := os.Getenv("MAX_ARTICLES")
+	if value == "" {
+		return defaultMaxArticles, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid MAX_ARTICLES %q: must be a non-negative integer", value)
+	}
+	return n, nil
+}
+
+// Reads how many seconds identical article submissions are deduplicated for
+// from DEDUP_WINDOW_SECONDS; unset or 0 turns deduplication off
+func dedupWindowFromEnv() (time.Duration, error) {
+	value := os.Getenv("DEDUP_WINDOW_SECONDS")
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid DEDUP_WINDOW_SECONDS %q: must be a non-negative integer", value)
+	}
+	return time.Duration(n) * time.Second, nil
+}
+
+// Registry holding the metrics served on /metrics
+var metricsRegistry = prometheus.NewRegistry()
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "http_requests_total",
+		Help: "Number of HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "status"})
+
+	httpRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "http_request_duration_seconds",
+		Help:    "HTTP request latency by method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route"})
+)
+
+func init() {
+	metricsRegistry.MustRegister(httpRequestsTotal, httpRequestDuration)
+}
+
+// Records request counts and latency per route for Prometheus
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+
+		// Label by route pattern rather than raw path to keep cardinality bounded
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		httpRequestsTotal.WithLabelValues(method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Sets the standard hardening headers; csp becomes the Content-Security-Policy
+func SecurityHeadersMiddleware(csp string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		header := c.Writer.Header()
+		header.Set("X-Content-Type-Options", "nosniff")
+		header.Set("X-Frame-Options", "DENY")
+		header.Set("Referrer-Policy", "no-referrer")
+		header.Set("Content-Security-Policy", csp)
+		c.Next()
+	}
+}
+
+// Caps the request body at maxBytes; binding a larger body fails with 413
+func BodySizeLimitMiddleware(maxBytes int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxBytes)
+		c.Next()
+	}
+}
+
+// Requires a JSON content type on write requests that carry a body
+func ContentTypeMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		hasBody := c.Request.ContentLength != 0
+		if hasBody && (c.Request.Method == http.MethodPost || c.Request.Method == http.MethodPut || c.Request.Method == http.MethodPatch) {
+			if !strings.HasPrefix(c.GetHeader("Content-Type"), "application/json") {
+				c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, Response{
+					Success:   false,
+					Error:     "Content type must be application/json",
+					RequestID: c.GetString("request_id"),
+				})
+				return
+			}
+		}
+		c.Next()
+	}
+}
+
+// Creating the handlers
+
+func ping(c *gin.Context) {
+	c.JSON(http.StatusOK, Response{
+		Success:   true,
+		Message:   "pong",
+		RequestID: c.GetString("request_id"),
+	})
+}
+
+// Runs after the global middlewares; gin has already set the Allow header
+func methodNotAllowed(c *gin.Context) {
+	respond(c, http.StatusMethodNotAllowed, Response{
+		Success:   false,
+		Error:     "method " + c.Request.Method + " not allowed",
+		RequestID: c.GetString("request_id"),
+	})
+}
+
+// Like methodNotAllowed, runs after RequestIDMiddleware so the id is set
+func notFound(c *gin.Context) {
+	respond(c, http.StatusNotFound, Response{
+		Success:   false,
+		Error:     "route not found",
+		RequestID: c.GetString("request_id"),
+	})
+}
+
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]interface{}{
+			"status":     "ok",
+			"started_at": startTime,
+		},
+	})
+}
+
+func getVersion(c *gin.Context) {
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data: map[string]string{
+			"version":    version,
+			"git_commit": gitCommit,
+			"build_time": buildTime,
+		},
+	})
+}
+
+func getArticles(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		page, limit, err := parsePagination(c)
+		if err != nil {
+			respond(c, http.StatusBadRequest, Response{
+				Success:   false,
+				Error:     err.Error(),
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+
+		less, ok := articleSorts[c.DefaultQuery("sort", "-created_at")]
+		if !ok {
+			respond(c, http.StatusBadRequest, Response{
+				Success:   false,
+				Error:     "sort must be one of created_at, -created_at, title, -title",
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+
+		includeDeleted := c.Query("include_deleted") == "true"
+		if includeDeleted && c.GetString("role") != "admin" {
+			respond(c, http.StatusForbidden, Response{
+				Success:   false,
+				Error:     "include_deleted requires admin access",
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+
+		category := c.Query("category")
+		if category != "" && !validCategory(category) {
+			respond(c, http.StatusBadRequest, Response{
+				Success:   false,
+				Error:     errUnknownCategory.Error(),
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+
+		// Any change to any article invalidates every page, so one timestamp covers them all
+		lastModified, err := store.LastModified()
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+		// A database store without any articles has no modification time yet
+		if !lastModified.IsZero() {
+			c.Header("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+			if notModifiedSince(c.GetHeader("If-Modified-Since"), lastModified) {
+				c.Status(http.StatusNotModified)
+				return
+			}
+		}
+
+		matched, err := store.List(ArticleFilter{
+			Author:         c.Query("author"),
+			Query:          c.Query("q"),
+			Category:       category,
+			Tag:            c.Query("tag"),
+			IncludeDeleted: includeDeleted,
+		})
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		// matched is already a copy, so sorting it leaves the stored order alone
+		sort.SliceStable(matched, func(i, j int) bool {
+			return less(matched[i], matched[j])
+		})
+
+		total := len(matched)
+		start := (page - 1) * limit
+		if start > total {
+			start = total
+		}
+		end := start + limit
+		if end > total {
+			end = total
+		}
+		var data interface{} = matched[start:end]
+		if fields := parseFields(c.Query("fields")); len(fields) > 0 {
+			data = projectArticles(matched[start:end], fields)
+		}
+
+		respond(c, http.StatusOK, Response{
+			Success: true,
+			Data:    data,
+			Meta: PageMeta{
+				Total:      total,
+				Page:       page,
+				TotalPages: (total + limit - 1) / limit,
+				Limit:      limit,
+			},
+			RequestID: c.GetString("request_id"),
+		})
+	}
+}
+
+// Pushes an event to the client every time an article changes, until it disconnects
+func streamArticles(c *gin.Context) {
+	events := articleEvents.subscribe()
+	defer articleEvents.unsubscribe(events)
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return false
+			}
+			c.SSEvent(event.Type, event.Article)
+			return true
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
+
+// Sends every article change to the client as a JSON message over a WebSocket
+func articlesWebSocket(c *gin.Context) {
+	conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade has already replied with an HTTP error
+		return
+	}
+	defer conn.Close()
+
+	events := articleEvents.subscribe()
+	defer articleEvents.unsubscribe(events)
+
+	// Clients only send control frames; reading keeps pongs flowing and notices disconnects
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+				return
+			}
+			if err := conn.WriteJSON(event); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-gone:
+			return
+		}
+	}
+}
+
+func getArticleById(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+
+		article, err := store.Get(id, false)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		etag := articleETag(article)
+		c.Header("ETag", etag)
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+
+		respond(c, http.StatusOK, Response{
+			Success:   true,
+			Data:      article,
+			RequestID: c.GetString("request_id"),
+		})
+	}
+}
+
+// Existence check for an article: the status and ETag of the GET without the body
+func headArticle(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+
+		article, err := store.Get(id, false)
+		if errors.Is(err, ErrArticleNotFound) {
+			c.Status(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+
+		etag := articleETag(article)
+		c.Header("ETag", etag)
+		if etagMatches(c.GetHeader("If-None-Match"), etag) {
+			c.Status(http.StatusNotModified)
+			return
+		}
+		c.Status(http.StatusOK)
 	}
+}
 
-	//protected routes
-	protected := r.Group("/")
-	protected.Use(AuthMiddleware())
-	{
-		protected.POST("/articles", createArticle)
-		protected.PUT("/articles/:id", updateArticle)
-		protected.DELETE("/article/:id", deleteArticle)
-		protected.GET("/admin/stats", getStats)
+// Creates an article. With a positive dedupWindow, an article identical to one
+// created within the window is not created again; the existing one is returned.
+func createArticle(store ArticleStore, dedupWindow time.Duration) gin.HandlerFunc {
+	var recent *idempotencyStore
+	var dedupMux sync.Mutex
+	if dedupWindow > 0 {
+		recent = newIdempotencyStore(dedupWindow)
+	}
+
+	return func(c *gin.Context) {
+		var input Article
+		if err := c.ShouldBindWith(&input, strictJSON); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		// A dry run only validates, the article the client would get has no ID yet
+		if c.Query("dry_run") == "true" {
+			input.ID = 0
+			respond(c, http.StatusOK, Response{Success: true, Data: input, Message: "article is valid"})
+			return
+		}
+
+		// Keys are scoped to the authenticated caller so clients can't replay each other's requests
+		idempotencyKey := c.GetHeader("Idempotency-Key")
+		if idempotencyKey != "" {
+			idempotentCreateMux.Lock()
+			defer idempotentCreateMux.Unlock()
+
+			idempotencyKey = c.GetString("principal") + "|" + idempotencyKey
+			if result, ok := createdArticles.get(idempotencyKey); ok {
+				Logger(c).Info("replaying idempotent article creation", "article_id", result.article.ID)
+				c.Header("Idempotent-Replayed", "true")
+				c.Header("Location", "/articles/"+strconv.Itoa(result.article.ID))
+				respond(c, result.status, Response{Success: true, Data: result.article})
+				return
+			}
+		}
+
+		// dedupMux is held until the hash is recorded so identical requests
+		// arriving together can't both create an article
+		var contentHash string
+		if recent != nil {
+			dedupMux.Lock()
+			defer dedupMux.Unlock()
+
+			contentHash = articleContentHash(input)
+			if result, ok := recent.get(contentHash); ok {
+				// The earlier article may have been deleted since, then a new one is created
+				if existing, err := store.Get(result.article.ID, false); err == nil {
+					if idempotencyKey != "" {
+						createdArticles.put(idempotencyKey, http.StatusOK, existing)
+					}
+					Logger(c).Info("duplicate article submission", "article_id", existing.ID)
+					c.Header("Location", "/articles/"+strconv.Itoa(existing.ID))
+					respond(c, http.StatusOK, Response{
+						Success: true,
+						Data:    existing,
+						Message: "identical article was created recently",
+					})
+					return
+				}
+			}
+		}
+
+		created, err := store.Create(input)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+		article := created[0]
+
+		if idempotencyKey != "" {
+			createdArticles.put(idempotencyKey, http.StatusCreated, article)
+		}
+		if recent != nil {
+			recent.put(contentHash, http.StatusCreated, article)
+		}
+		Logger(c).Info("article created", "article_id", article.ID, "author", article.Author)
+
+		c.Header("Location", "/articles/"+strconv.Itoa(article.ID))
+		respond(c, http.StatusCreated, Response{Success: true, Data: article})
 	}
+}
 
-	log.Println("Server running on :8080")
-	r.Run(":8080")
+// Hash identifying articles with the same title, content and author
+func articleContentHash(a Article) string {
+	sum := sha256.Sum256([]byte(a.Title + "\x00" + a.Content + "\x00" + a.Author))
+	return hex.EncodeToString(sum[:])
 }
 
-// essential middlewares
+func createArticlesBatch(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var items []json.RawMessage
+		err := c.ShouldBindJSON(&items)
+		// A null body decodes to a nil slice without an error
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) || (err == nil && items == nil) {
+			err = errors.New("request body must be a JSON array of articles")
+		}
+		if err != nil {
+			respondBindError(c, err)
+			return
+		}
 
-func ErrorHandlerMiddleware() gin.HandlerFunc {
-	return gin.CustomRecovery(func(c *gin.Context, recovered interface{}) {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, Response{
-			Success:   false,
-			Error:     "interal server error",
+		results := make([]BatchResult, len(items))
+		valid := make([]Article, 0, len(items))
+		validIndexes := make([]int, 0, len(items))
+		for i, raw := range items {
+			results[i].Index = i
+			var input Article
+			if err := strictJSON.BindBody(raw, &input); err != nil {
+				results[i].Error = err.Error()
+				if errs := fieldErrors(err); errs != nil {
+					results[i].Error = "validation failed"
+					results[i].Errors = errs
+				}
+				continue
+			}
+			valid = append(valid, input)
+			validIndexes = append(validIndexes, i)
+		}
+
+		created, err := store.Create(valid...)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		for j, i := range validIndexes {
+			results[i].Success = true
+			results[i].Data = created[j]
+		}
+
+		status := http.StatusCreated
+		if len(valid) < len(items) {
+			status = http.StatusMultiStatus
+		}
+		respond(c, status, Response{
+			Success:   len(valid) == len(items),
+			Data:      results,
 			RequestID: c.GetString("request_id"),
 		})
-	})
+	}
 }
 
-func RequestIDMiddleware() gin.HandlerFunc {
+func updateArticle(store ArticleStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		id := uuid.New().String()
-		c.Set("request_id", id)
-		c.Writer.Header().Set("X-Request-ID", id)
-		c.Next()
+		id, _ := strconv.Atoi(c.Param("id"))
+		var input Article
+		if err := c.ShouldBindWith(&input, normalizedJSON); err != nil {
+			respondBindError(c, err)
+			return
+		}
+
+		version, err := expectedVersion(c.GetHeader("If-Match"), input.Version)
+		if err != nil {
+			status := http.StatusBadRequest
+			if c.GetHeader("If-Match") == "" {
+				status = http.StatusPreconditionRequired
+			}
+			respond(c, status, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+			return
+		}
+
+		var current Article
+		updated, err := store.Update(id, func(a *Article) error {
+			if a.Version != version {
+				current = *a
+				return ErrVersionConflict
+			}
+			a.Title = input.Title
+			a.Content = input.Content
+			a.Author = input.Author
+			a.Category = input.Category
+			a.Tags = input.Tags
+			return nil
+		})
+		if errors.Is(err, ErrVersionConflict) {
+			respond(c, http.StatusConflict, Response{
+				Success:   false,
+				Error:     fmt.Sprintf("article was modified, current version is %d", current.Version),
+				Data:      current,
+				RequestID: c.GetString("request_id"),
+			})
+			return
+		}
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		respond(c, http.StatusOK, Response{Success: true, Data: updated})
 	}
 }
 
-func LoggingMiddleware() gin.HandlerFunc {
+func patchArticle(store ArticleStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		start := time.Now()
-		c.Next()
+		id, _ := strconv.Atoi(c.Param("id"))
 
-		reqID, _ := c.Get("request_id")
-		duration := time.Since(start)
+		var input ArticlePatch
+		if err := c.ShouldBindJSON(&input); err != nil {
+			respondBindError(c, err)
+			return
+		}
 
-		log.Printf(
-			"[%s] %s %s %d %s %s %s",
-			reqID,
-			c.Request.Method,
-			c.Request.URL.Path,
-			c.Writer.Status(),
-			duration,
-			c.ClientIP(),
-			c.Request.UserAgent(),
-		)
+		var invalid error
+		updated, err := store.Update(id, func(a *Article) error {
+			if input.Title != nil {
+				a.Title = *input.Title
+			}
+			if input.Content != nil {
+				a.Content = *input.Content
+			}
+			if input.Author != nil {
+				a.Author = *input.Author
+			}
+			if input.Category != nil {
+				a.Category = *input.Category
+			}
+			if input.Tags != nil {
+				a.Tags = *input.Tags
+			}
+			a.Normalize()
+			invalid = validateArticle(*a)
+			return invalid
+		})
+		if invalid != nil {
+			respondBindError(c, invalid)
+			return
+		}
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		respond(c, http.StatusOK, Response{Success: true, Data: updated})
 	}
 }
 
-func AuthMiddleware() gin.HandlerFunc {
-	apiKeys := map[string]string{
-		"admin-key":    "admin",
-		"user-key-456": "user",
+func deleteArticle(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+
+		// Soft delete so the article can still be audited or restored
+		if _, err := store.Delete(id); err != nil {
+			respondStoreError(c, err)
+			return
+		}
+		respond(c, http.StatusOK, Response{Success: true, Message: "article deleted"})
 	}
+}
 
+// Soft-deletes several articles at once, reporting which ids were not found
+func deleteArticles(store ArticleStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		key := c.GetHeader("X-API-Key")
-		role, ok := apiKeys[key]
-		if !ok {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, Response{
+		var input BulkDeleteInput
+		if err := c.ShouldBindWith(&input, strictJSON); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if len(input.IDs) == 0 {
+			respond(c, http.StatusBadRequest, Response{
 				Success:   false,
-				Error:     "invalid or missing API key",
+				Error:     "ids must list at least one article id",
 				RequestID: c.GetString("request_id"),
 			})
+			return
 		}
-		c.Set("role", role)
-		c.Next()
+
+		deleted, err := store.DeleteMany(input.IDs)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		deletedIDs := make(map[int]bool, len(deleted))
+		for _, article := range deleted {
+			deletedIDs[article.ID] = true
+		}
+		// Repeated ids all report the one deletion
+		status := http.StatusOK
+		results := make([]BulkDeleteResult, len(input.IDs))
+		for i, id := range input.IDs {
+			results[i] = BulkDeleteResult{ID: id, Deleted: deletedIDs[id]}
+			if !deletedIDs[id] {
+				results[i].Error = ErrArticleNotFound.Error()
+				status = http.StatusMultiStatus
+			}
+		}
+
+		respond(c, status, Response{
+			Success:   status == http.StatusOK,
+			Data:      results,
+			Message:   strconv.Itoa(len(deleted)) + " articles deleted",
+			RequestID: c.GetString("request_id"),
+		})
 	}
 }
 
-func CORSMiddleware() gin.HandlerFunc {
-	allowedOrigins := map[string]bool{
-		"http://localhost:3000": true,
-		"https://myblog.com":    true,
+func restoreArticle(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, _ := strconv.Atoi(c.Param("id"))
+
+		article, err := store.Restore(id)
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+
+		respond(c, http.StatusOK, Response{Success: true, Data: article, Message: "article restored"})
 	}
+}
 
+func addAPIKey(store *MemoryKeyStore) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		origin := c.GetHeader("Origin")
-		if allowedOrigins[origin] {
-			c.Writer.Header().Set("Access-Control-Allow-Origin", origin)
+		var input APIKeyInput
+		if err := c.ShouldBindJSON(&input); err != nil {
+			respondBindError(c, err)
+			return
+		}
+		if !apiKeyRoles[input.Role] {
+			respond(c, http.StatusBadRequest, Response{Success: false, Error: "role must be admin or user", RequestID: c.GetString("request_id")})
+			return
+		}
+		if input.Key == "" {
+			input.Key = uuid.NewString()
 		}
-		c.Writer.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Writer.Header().Set("Access-Control-Allow-Headers", "Content-type, X-API-Key, X-Request-ID")
 
-		if c.Request.Method == http.MethodOptions {
-			c.AbortWithStatus(http.StatusNoContent)
+		if !store.AddKey(input.Key, input.Role) {
+			respond(c, http.StatusConflict, Response{Success: false, Error: "API key already exists", RequestID: c.GetString("request_id")})
 			return
 		}
+		respond(c, http.StatusCreated, Response{Success: true, Data: input})
+	}
+}
 
-		c.Next()
+func removeAPIKey(store *MemoryKeyStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch err := store.RemoveKey(c.Param("key")); {
+		case errors.Is(err, ErrAPIKeyNotFound):
+			respond(c, http.StatusNotFound, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+		case errors.Is(err, ErrLastAdminKey):
+			respond(c, http.StatusConflict, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+		default:
+			respond(c, http.StatusOK, Response{Success: true, Message: "API key removed"})
+		}
 	}
 }
 
-func RateLimitMiddleware() gin.HandlerFunc {
-	var visitors = make(map[string]*rate.Limiter)
-	var mu sync.Mutex
+func getStats(store ArticleStore) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		live, err := store.List(ArticleFilter{})
+		if err != nil {
+			respondStoreError(c, err)
+			return
+		}
+		total := len(live)
 
-	getLimiter := func(ip string) *rate.Limiter {
-		mu.Lock()
-		defer mu.Unlock()
+		stats := map[string]interface{}{
+			"total_articles": total,
+			"uptime":         time.Since(startTime).Round(time.Millisecond).String(),
+			"request_count":  requestCount.Load(),
+		}
 
-		limiter, exists := visitors[ip]
-		if !exists {
-			limiter = rate.NewLimiter(rate.Every(time.Minute/100), 100)
-			visitors[ip] = limiter
+		c.JSON(http.StatusOK, Response{Success: true, Data: stats})
+	}
+}
+
+// Strong ETag for an article, changing whenever the article is updated
+func articleETag(a Article) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d-%d", a.ID, a.UpdatedAt.UnixNano())))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Reports whether a change at lastModified is not newer than the If-Modified-Since
+// header. HTTP dates only have whole seconds, so the sub-second part is ignored.
+func notModifiedSince(header string, lastModified time.Time) bool {
+	if header == "" {
+		return false
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return false
+	}
+	return !lastModified.Truncate(time.Second).After(since)
+}
+
+// Returns the article version a full update expects, taken from the If-Match
+// header (quotes optional) or else the version field of the body
+func expectedVersion(ifMatch string, bodyVersion int) (int, error) {
+	if ifMatch == "" {
+		if bodyVersion < 1 {
+			return 0, errors.New("the expected version must be sent in the If-Match header or the version field")
 		}
-		return limiter
+		return bodyVersion, nil
 	}
-	return func(c *gin.Context) {
-		ip := c.ClientIP()
-		limiter := getLimiter(ip)
+	version, err := strconv.Atoi(strings.Trim(strings.TrimPrefix(strings.TrimSpace(ifMatch), "W/"), `"`))
+	if err != nil || version < 1 {
+		return 0, errors.New(`the If-Match header must be the article version, e.g. "3"`)
+	}
+	return version, nil
+}
+
+// Reports whether an If-None-Match header value matches etag
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
 
-		c.Header("X-RateLimit-Limit", "100")
+// An article reduced to the fields asked for with ?fields=, keyed by JSON name
+type sparseArticle map[string]interface{}
 
-		if !limiter.Allow() {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, Response{
-				Success:   false,
-				Error:     "too many requests, limit exceeded",
-				RequestID: c.GetString("request_id"),
-			})
-			return
+// encoding/xml can't marshal maps, so the fields are written as child elements in name order
+func (a sparseArticle) MarshalXML(e *xml.Encoder, start xml.StartElement) error {
+	names := make([]string, 0, len(a))
+	for name := range a {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	if err := e.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := e.EncodeElement(a[name], xml.StartElement{Name: xml.Name{Local: name}}); err != nil {
+			return err
 		}
-		c.Next()
 	}
+	return e.EncodeToken(start.End())
 }
 
-func ContentTypeMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if c.Request.Method == http.MethodPost || c.Request.Method == http.MethodPut {
-			if !strings.HasPrefix(c.GetHeader("Content-Type"), "application/json") {
-				c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, Response{
-					Success:   false,
-					Error:     "Content type must be application/json",
-					RequestID: c.GetString("request_id"),
-				})
-				return
-			}
+// Index of each Article field by its JSON name
+var articleFieldIndex = func() map[string]int {
+	index := make(map[string]int)
+	t := reflect.TypeOf(Article{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		index[name] = i
+	}
+	return index
+}()
+
+// Parses a comma separated fields parameter, dropping names Article doesn't have
+func parseFields(param string) []string {
+	var fields []string
+	for _, name := range strings.Split(param, ",") {
+		name = strings.TrimSpace(name)
+		if _, ok := articleFieldIndex[name]; ok {
+			fields = append(fields, name)
 		}
-		c.Next()
 	}
+	return fields
 }
 
-// Creating the handlers
+func projectArticles(list []Article, fields []string) []sparseArticle {
+	projected := make([]sparseArticle, len(list))
+	for i, a := range list {
+		v := reflect.ValueOf(a)
+		projected[i] = make(sparseArticle, len(fields))
+		for _, name := range fields {
+			projected[i][name] = v.Field(articleFieldIndex[name]).Interface()
+		}
+	}
+	return projected
+}
 
-func ping(c *gin.Context) {
-	c.JSON(http.StatusOK, Response{
-		Success:   true,
-		Message:   "pong",
-		RequestID: c.GetString("request_id"),
-	})
+// Returns a new slice with the articles matching every non-empty filter,
+// leaving out soft-deleted articles unless includeDeleted is set.
+// author is compared case-insensitively; q is a case-insensitive substring
+// of the title or content; category must match exactly.
+func filterArticles(list []Article, author, q, category, tag string, includeDeleted bool) []Article {
+	q = strings.ToLower(q)
+	matched := make([]Article, 0, len(list))
+	for _, a := range list {
+		if a.Deleted && !includeDeleted {
+			continue
+		}
+		if author != "" && !strings.EqualFold(a.Author, author) {
+			continue
+		}
+		if category != "" && a.Category != category {
+			continue
+		}
+		if tag != "" && !slices.Contains(a.Tags, tag) {
+			continue
+		}
+		if q != "" && !strings.Contains(strings.ToLower(a.Title), q) &&
+			!strings.Contains(strings.ToLower(a.Content), q) {
+			continue
+		}
+		matched = append(matched, a)
+	}
+	return matched
 }
 
-func getArticles(c *gin.Context) {
-	c.JSON(http.StatusOK, Response{
-		Success:   true,
-		Data:      articles,
-		RequestID: c.GetString("request_id"),
-	})
+// Reads the page and limit query parameters, applying defaults and clamping the limit
+func parsePagination(c *gin.Context) (int, int, error) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("page must be a positive integer")
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultPageLimit)))
+	if err != nil || limit < 1 {
+		return 0, 0, errors.New("limit must be a positive integer")
+	}
+	if limit > maxPageLimit {
+		limit = maxPageLimit
+	}
+	return page, limit, nil
+}
+
+// Renders resp as XML when the client asks for it, and as JSON otherwise
+func respond(c *gin.Context, status int, resp Response) {
+	switch c.NegotiateFormat(gin.MIMEJSON, gin.MIMEXML, gin.MIMEXML2) {
+	case gin.MIMEXML, gin.MIMEXML2:
+		c.XML(status, resp)
+	default:
+		c.JSON(status, resp)
+	}
 }
 
-func getArticleById(c *gin.Context) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	article, _ := findArticleByID(id)
+// Maps ArticleStore errors to a response; anything unexpected is a 500
+func respondStoreError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ErrArticleNotFound):
+		respond(c, http.StatusNotFound, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+	case errors.Is(err, ErrArticleNotDeleted):
+		respond(c, http.StatusBadRequest, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+	case errors.Is(err, ErrArticleLimit):
+		respond(c, http.StatusInsufficientStorage, Response{Success: false, Error: err.Error(), RequestID: c.GetString("request_id")})
+	default:
+		Logger(c).Error("article store failed", "error", err)
+		respond(c, http.StatusInternalServerError, Response{Success: false, Error: "internal server error", RequestID: c.GetString("request_id")})
+	}
+}
 
-	if article == nil {
-		c.JSON(http.StatusNotFound, Response{
+// Writes the response for a failed JSON bind, using 413 when the body was too large
+func respondBindError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		respond(c, http.StatusRequestEntityTooLarge, Response{
 			Success:   false,
-			Error:     "article not found",
+			Error:     "request body too large",
 			RequestID: c.GetString("request_id"),
 		})
 		return
 	}
-
-	c.JSON(http.StatusOK, Response{
-		Success:   true,
-		Data:      article,
+	if errs := fieldErrors(err); errs != nil {
+		respond(c, http.StatusBadRequest, Response{
+			Success:   false,
+			Error:     "validation failed",
+			Errors:    errs,
+			RequestID: c.GetString("request_id"),
+		})
+		return
+	}
+	respond(c, http.StatusBadRequest, Response{
+		Success:   false,
+		Error:     err.Error(),
 		RequestID: c.GetString("request_id"),
 	})
 }
 
-func createArticle(c *gin.Context) {
-	var input Article
-	if err := c.ShouldBindJSON(&input); err != nil {
-		c.JSON(http.StatusBadRequest, Response{Success: false, Error: err.Error()})
-		return
-	}
-
-	if err := validateArticle(input); err != nil {
-		c.JSON(http.StatusBadRequest, Response{Success: false, Error: err.Error()})
-		return
-	}
-
-	articleMux.Lock()
-	defer articleMux.Unlock()
+// Checks an article against the binding tags on Article, for articles that
+// were not bound by gin such as patched articles
+func validateArticle(article Article) error {
+	return binding.Validator.ValidateStruct(article)
+}
 
-	input.ID = nextId
-	nextId++
-	input.CreatedAt = time.Now()
-	input.UpdatedAt = time.Now()
-	articles = append(articles, input)
+// Implemented by bodies that clean up their input before being validated
+type normalizer interface {
+	Normalize()
+}
 
-	c.JSON(http.StatusCreated, Response{Success: true, Data: input})
+// JSON binding that normalizes the target before validating it. The strict
+// one also rejects keys the target struct doesn't have, so typos like
+// "titel" fail instead of being silently dropped.
+type jsonBinding struct {
+	strict bool
 }
 
-func updateArticle(c *gin.Context) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	article, index := findArticleByID(id)
+var (
+	normalizedJSON = jsonBinding{}
+	strictJSON     = jsonBinding{strict: true}
+)
 
-	if article == nil {
-		c.JSON(http.StatusNotFound, Response{Success: false, Error: "article not found"})
-		return
+func (b jsonBinding) Name() string {
+	if b.strict {
+		return "strict json"
 	}
+	return "json"
+}
 
-	var input Article
-	c.ShouldBindJSON(&input)
-
-	articles[index].Title = input.Title
-	articles[index].Content = input.Content
-	articles[index].Author = input.Author
-	articles[index].UpdatedAt = time.Now()
-
-	c.JSON(http.StatusOK, Response{Success: true, Data: articles[index]})
+func (b jsonBinding) Bind(req *http.Request, obj interface{}) error {
+	if req == nil || req.Body == nil {
+		return errors.New("invalid request")
+	}
+	return b.decode(req.Body, obj)
 }
 
-func deleteArticle(c *gin.Context) {
-	id, _ := strconv.Atoi(c.Param("id"))
-	_, index := findArticleByID(id)
+func (b jsonBinding) BindBody(body []byte, obj interface{}) error {
+	return b.decode(bytes.NewReader(body), obj)
+}
 
-	if index == -1 {
-		c.JSON(http.StatusNotFound, Response{Success: false, Error: "article not found"})
-		return
+func (b jsonBinding) decode(r io.Reader, obj interface{}) error {
+	decoder := json.NewDecoder(r)
+	if b.strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(obj); err != nil {
+		return err
 	}
+	if n, ok := obj.(normalizer); ok {
+		n.Normalize()
+	}
+	return binding.Validator.ValidateStruct(obj)
+}
 
-	articles = append(articles[:index], articles[index+1:]...)
-	c.JSON(http.StatusOK, Response{Success: true, Message: "article deleted"})
+// Returns the key named by an unknown field error; encoding/json has no
+// error type for it, only the message
+func unknownField(err error) (string, bool) {
+	rest, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !ok {
+		return "", false
+	}
+	field, err := strconv.Unquote(rest)
+	return field, err == nil
 }
 
-func getStats(c *gin.Context) {
-	if c.GetString("role") != "admin" {
-		c.JSON(http.StatusForbidden, Response{Success: false, Error: "admin access required"})
-		return
+// Describes each failed validation rule or unknown field in err, or returns
+// nil when err is neither
+func fieldErrors(err error) []FieldError {
+	if field, ok := unknownField(err); ok {
+		return []FieldError{{Field: field, Message: "is not a known field"}}
+	}
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
 	}
 
-	stats := map[string]interface{}{
-		"total_articles": len(articles),
-		"uptime":         "24h",
+	errs := make([]FieldError, len(validationErrs))
+	for i, fe := range validationErrs {
+		errs[i] = FieldError{Field: fe.Field(), Message: validationMessage(fe)}
 	}
+	return errs
+}
 
-	c.JSON(http.StatusOK, Response{Success: true, Data: stats})
+func validationMessage(fe validator.FieldError) string {
+	// ActualTag looks through the aliases registered in init
+	switch fe.ActualTag() {
+	case "required":
+		return "is required"
+	case "max":
+		if fe.Kind() == reflect.Slice {
+			return "must have at most " + fe.Param() + " items"
+		}
+		return "must be at most " + fe.Param() + " characters"
+	case "article_category":
+		return "must be one of " + strings.Join(articleCategories, ", ")
+	default:
+		return "failed the " + fe.Tag() + " rule"
+	}
 }
 
-func findArticleByID(id int) (*Article, int) {
-	for i, a := range articles {
-		if a.ID == id {
-			return &a, i
+// Teaches gin's validator the custom article rules and to report fields by their JSON name
+func init() {
+	v, ok := binding.Validator.Engine().(*validator.Validate)
+	if !ok {
+		return
+	}
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" {
+			return field.Name
 		}
+		return name
+	})
+	v.RegisterValidation("article_category", func(fl validator.FieldLevel) bool {
+		return validCategory(fl.Field().String())
+	})
+	// The length limits live in the constants, which the OpenAPI spec also reads
+	v.RegisterAlias("article_title", "required,max="+strconv.Itoa(maxTitleLength))
+	v.RegisterAlias("article_content", "required,max="+strconv.Itoa(maxContentLength))
+	v.RegisterAlias("article_author", "required,max="+strconv.Itoa(maxAuthorLength))
+	v.RegisterAlias("article_tags", "max="+strconv.Itoa(maxTags))
+	v.RegisterAlias("article_tag", "required,max="+strconv.Itoa(maxTagLength))
+}
+
+// Trims the text fields and tags and collapses runs of whitespace inside the title
+func (a *Article) Normalize() {
+	a.Title = strings.Join(strings.Fields(a.Title), " ")
+	a.Content = strings.TrimSpace(a.Content)
+	a.Author = strings.TrimSpace(a.Author)
+	for i, tag := range a.Tags {
+		a.Tags[i] = strings.TrimSpace(tag)
 	}
-	return nil, -1
 }
 
-func validateArticle(article Article) error {
-	if article.Title == "" || article.Content == "" || article.Author == "" {
-		return gin.Error{Err: http.ErrMissingFile}
+func validCategory(category string) bool {
+	for _, c := range articleCategories {
+		if c == category {
+			return true
+		}
 	}
-	return nil
+	return false
 }
@@ -0,0 +1,3126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	// Handlers tested without RequestIDMiddleware log to the default logger
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	os.Exit(m.Run())
+}
+
+// Store holding copies of the seed articles, without the cap or events main uses
+func newTestStore() *MemoryArticleStore {
+	return NewMemoryArticleStore(seedArticles, 0, nil)
+}
+
+// Router wired like main's, logging nowhere
+func newTestRouter(store ArticleStore) *gin.Engine {
+	return newRouter(routerConfig{
+		store:      store,
+		keys:       NewMemoryKeyStore(defaultAPIKeys),
+		logOutput:  io.Discard,
+		rateLimits: defaultRateLimitTiers,
+	})
+}
+
+// Sends a request through h; headers are given as name, value pairs
+func performRequest(h http.Handler, method, path, body string, headers ...string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+// Decodes the Response envelope, unmarshalling its data into data when it isn't nil
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, data interface{}) Response {
+	t.Helper()
+	resp := Response{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestAuthMiddlewareStopsUnauthenticatedRequests(t *testing.T) {
+	tests := []struct {
+		name       string
+		key        string
+		wantStatus int
+		wantRun    bool
+	}{
+		{"missing key", "", http.StatusUnauthorized, false},
+		{"unknown key", "not-a-key", http.StatusUnauthorized, false},
+		{"valid key", "user-key-456", http.StatusCreated, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ran := false
+			r := gin.New()
+			r.POST("/articles", AuthMiddleware(NewMemoryKeyStore(defaultAPIKeys)), func(c *gin.Context) {
+				ran = true
+				c.Status(http.StatusCreated)
+			})
+
+			w := performRequest(r, http.MethodPost, "/articles", `{}`, "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ran != tt.wantRun {
+				t.Fatalf("handler ran = %v, want %v", ran, tt.wantRun)
+			}
+		})
+	}
+}
+
+func TestCreateArticleWithoutAPIKeyIsRejected(t *testing.T) {
+	store := newTestStore()
+	r := newTestRouter(store)
+
+	w := performRequest(r, http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+	if resp := decodeResponse(t, w, nil); resp.Success || resp.Error != "invalid or missing API key" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	list, _ := store.List(ArticleFilter{})
+	if len(list) != len(seedArticles) {
+		t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles))
+	}
+}
+
+func TestDeleteArticleRoute(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	w := performRequest(r, http.MethodPost, "/articles", `{"title":"Doomed","content":"c","author":"a"}`, "X-API-Key", "admin-key")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var created Article
+	decodeResponse(t, w, &created)
+
+	path := "/articles/" + strconv.Itoa(created.ID)
+	w = performRequest(r, http.MethodDelete, path, "", "X-API-Key", "admin-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("delete status = %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if resp := decodeResponse(t, w, nil); !resp.Success || resp.Message != "article deleted" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	if w = performRequest(r, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get after delete status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestResponseJSONKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		resp Response
+		want string
+	}{
+		{"success", Response{Success: true}, `{"success":true}`},
+		{"failure", Response{Success: false, Error: "boom"}, `{"success":false,"error":"boom"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(tt.resp)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.want {
+				t.Fatalf("got %s, want %s", data, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryArticleStoreUpdateIsVisible(t *testing.T) {
+	store := newTestStore()
+
+	_, err := store.Update(1, func(a *Article) error {
+		a.Title = "Changed through the pointer"
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := store.Get(1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Title != "Changed through the pointer" {
+		t.Fatalf("title = %q, the change was lost", got.Title)
+	}
+	if got.Version != 2 {
+		t.Fatalf("version = %d, want 2", got.Version)
+	}
+}
+
+func TestUpdateArticleRejectsBadBodies(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantFields []string
+	}{
+		{"malformed json", `{"title":`, nil},
+		{"missing required fields", `{"content":"only content","version":1}`, []string{"title", "author"}},
+		{"blank title and author", `{"title":"  ","content":"c","author":"","version":1}`, []string{"title", "author"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodPut, "/articles/1", tt.body, "X-API-Key", "admin-key")
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+			}
+			resp := decodeResponse(t, w, nil)
+			for _, field := range tt.wantFields {
+				if !slices.ContainsFunc(resp.Errors, func(fe FieldError) bool { return fe.Field == field }) {
+					t.Errorf("no error reported for %s in %+v", field, resp.Errors)
+				}
+			}
+
+			got, _ := store.Get(1, false)
+			if got.Title != seedArticles[0].Title || got.Version != 1 {
+				t.Fatalf("stored article changed to %+v", got)
+			}
+		})
+	}
+}
+
+// KeyStore answering from a plain map
+type fakeKeyStore map[string]string
+
+func (s fakeKeyStore) Lookup(key string) (string, bool) {
+	role, ok := s[key]
+	return role, ok
+}
+
+func TestAuthMiddlewareUsesKeyStore(t *testing.T) {
+	store := fakeKeyStore{"editor-key": "editor", "reader-key": "reader"}
+	tests := []struct {
+		key        string
+		wantStatus int
+		wantRole   string
+	}{
+		{"editor-key", http.StatusOK, "editor"},
+		{"reader-key", http.StatusOK, "reader"},
+		{"admin-key", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/whoami", AuthMiddleware(store), func(c *gin.Context) {
+				c.String(http.StatusOK, c.GetString("role"))
+			})
+
+			w := performRequest(r, http.MethodGet, "/whoami", "", "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK && w.Body.String() != tt.wantRole {
+				t.Fatalf("role = %q, want %q", w.Body.String(), tt.wantRole)
+			}
+		})
+	}
+}
+
+func TestMemoryKeyStoreLookup(t *testing.T) {
+	store := NewMemoryKeyStore(defaultAPIKeys)
+	for key, want := range defaultAPIKeys {
+		if role, ok := store.Lookup(key); !ok || role != want {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, true", key, role, ok, want)
+		}
+	}
+	if _, ok := store.Lookup("missing"); ok {
+		t.Error("Lookup found a key that was never added")
+	}
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name       string
+		role       string
+		wantStatus int
+	}{
+		{"allowed role", "admin", http.StatusOK},
+		{"other allowed role", "editor", http.StatusOK},
+		{"disallowed role", "user", http.StatusForbidden},
+		{"missing role", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/admin", func(c *gin.Context) {
+				if tt.role != "" {
+					c.Set("role", tt.role)
+				}
+			}, RequireRole("admin", "editor"), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := performRequest(r, http.MethodGet, "/admin", "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestAdminStatsRequiresAdmin(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	tests := []struct {
+		key        string
+		wantStatus int
+	}{
+		{"admin-key", http.StatusOK},
+		{"user-key-456", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		w := performRequest(r, http.MethodGet, "/admin/stats", "", "X-API-Key", tt.key)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.key, w.Code, tt.wantStatus)
+		}
+	}
+}
+
+func TestBodySizeLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		content    string
+		wantStatus int
+	}{
+		{"within limit", "short", http.StatusCreated},
+		{"over limit", strings.Repeat("a", maxBodyBytes+1), http.StatusRequestEntityTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+			body := `{"title":"t","content":"` + tt.content + `","author":"a"}`
+
+			w := performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			resp := decodeResponse(t, w, nil)
+			if tt.wantStatus == http.StatusRequestEntityTooLarge {
+				if resp.Error != "request body too large" || resp.RequestID == "" {
+					t.Fatalf("unexpected response %+v", resp)
+				}
+			}
+		})
+	}
+}
+
+func articleIDs(list []Article) []int {
+	ids := make([]int, len(list))
+	for i, a := range list {
+		ids[i] = a.ID
+	}
+	return ids
+}
+
+func TestGetArticlesSort(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewMemoryArticleStore([]Article{
+		{ID: 1, Title: "B", Content: "c", Author: "a", CreatedAt: base, Version: 1},
+		{ID: 2, Title: "C", Content: "c", Author: "a", CreatedAt: base.Add(2 * time.Hour), Version: 1},
+		{ID: 3, Title: "A", Content: "c", Author: "a", CreatedAt: base.Add(time.Hour), Version: 1},
+	}, 0, nil)
+	r := newTestRouter(store)
+
+	tests := []struct {
+		sort       string
+		wantStatus int
+		wantIDs    []int
+	}{
+		{"", http.StatusOK, []int{2, 3, 1}},
+		{"created_at", http.StatusOK, []int{1, 3, 2}},
+		{"-created_at", http.StatusOK, []int{2, 3, 1}},
+		{"title", http.StatusOK, []int{3, 1, 2}},
+		{"-title", http.StatusOK, []int{2, 1, 3}},
+		{"author", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run("sort="+tt.sort, func(t *testing.T) {
+			path := "/articles"
+			if tt.sort != "" {
+				path += "?sort=" + tt.sort
+			}
+			w := performRequest(r, http.MethodGet, path, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list []Article
+			decodeResponse(t, w, &list)
+			if got := articleIDs(list); !slices.Equal(got, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+
+	// Sorting works on a copy, the store keeps insertion order
+	list, _ := store.List(ArticleFilter{})
+	if got := articleIDs(list); !slices.Equal(got, []int{1, 2, 3}) {
+		t.Fatalf("stored order = %v, want [1 2 3]", got)
+	}
+}
+
+func TestHealthzIgnoresRateLimit(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	limited := false
+	for i := 0; i < defaultRateLimitTiers[anonymousRole].Burst+10; i++ {
+		if performRequest(r, http.MethodGet, "/ping", "").Code == http.StatusTooManyRequests {
+			limited = true
+		}
+	}
+	if !limited {
+		t.Fatal("expected /ping to be rate limited")
+	}
+
+	for i := 0; i < 100; i++ {
+		w := performRequest(r, http.MethodGet, "/healthz", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+	var health map[string]interface{}
+	decodeResponse(t, performRequest(r, http.MethodGet, "/healthz", ""), &health)
+	if health["status"] != "ok" {
+		t.Fatalf("status = %v, want ok", health["status"])
+	}
+	if _, ok := health["started_at"]; !ok {
+		t.Fatal("started_at missing")
+	}
+}
+
+func TestGetStatsUptime(t *testing.T) {
+	startTime = time.Now()
+	r := newTestRouter(newTestStore())
+	time.Sleep(20 * time.Millisecond)
+
+	w := performRequest(r, http.MethodGet, "/admin/stats", "", "X-API-Key", "admin-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var stats map[string]interface{}
+	decodeResponse(t, w, &stats)
+
+	uptime, ok := stats["uptime"].(string)
+	if !ok {
+		t.Fatalf("uptime = %v, want a string", stats["uptime"])
+	}
+	d, err := time.ParseDuration(uptime)
+	if err != nil {
+		t.Fatalf("uptime %q does not parse: %v", uptime, err)
+	}
+	if d <= 0 {
+		t.Fatalf("uptime = %v, want more than zero", d)
+	}
+	if _, ok := stats["request_count"].(float64); !ok {
+		t.Fatalf("request_count = %v, want a number", stats["request_count"])
+	}
+}
+
+func TestLoggingMiddlewareFormats(t *testing.T) {
+	tests := []struct {
+		name       string
+		jsonFormat bool
+	}{
+		{"text", false},
+		{"json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			r := gin.New()
+			r.Use(RequestIDMiddleware(slog.New(slog.DiscardHandler)), LoggingMiddleware(&out, tt.jsonFormat))
+			r.GET("/ping", ping)
+
+			performRequest(r, http.MethodGet, "/ping", "", "User-Agent", "tester", "X-Request-ID", "req-1")
+			line := strings.TrimSpace(out.String())
+			if strings.Count(line, "\n") != 0 {
+				t.Fatalf("want one line per request, got %q", line)
+			}
+
+			if !tt.jsonFormat {
+				if !strings.Contains(line, "[req-1] GET /ping 200") || !strings.HasSuffix(line, "tester") {
+					t.Fatalf("unexpected log line %q", line)
+				}
+				return
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				t.Fatalf("log line %q is not JSON: %v", line, err)
+			}
+			for _, key := range []string{"request_id", "method", "path", "status", "duration_ms", "client_ip", "user_agent"} {
+				if _, ok := entry[key]; !ok {
+					t.Errorf("key %s missing from %q", key, line)
+				}
+			}
+			if entry["request_id"] != "req-1" || entry["path"] != "/ping" || entry["status"] != float64(200) {
+				t.Fatalf("unexpected entry %v", entry)
+			}
+		})
+	}
+}
+
+func TestTimeoutMiddleware(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"fast handler", "/fast", http.StatusOK, "done"},
+		{"slow handler", "/slow", http.StatusServiceUnavailable, ""},
+		{"skipped route", "/stream", http.StatusOK, "streamed"},
+	}
+	r := gin.New()
+	r.Use(RequestIDMiddleware(slog.New(slog.DiscardHandler)), TimeoutMiddleware(20*time.Millisecond, "/stream"))
+	r.GET("/fast", func(c *gin.Context) {
+		c.String(http.StatusOK, "done")
+	})
+	r.GET("/slow", func(c *gin.Context) {
+		// Writing after the deadline must not reach the client
+		<-c.Request.Context().Done()
+		c.String(http.StatusOK, "too late")
+	})
+	r.GET("/stream", func(c *gin.Context) {
+		time.Sleep(40 * time.Millisecond)
+		c.String(http.StatusOK, "streamed")
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, tt.path, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				resp := decodeResponse(t, w, nil)
+				if resp.Error != "request timed out" || resp.RequestID == "" {
+					t.Fatalf("unexpected response %+v", resp)
+				}
+				return
+			}
+			if w.Body.String() != tt.wantBody {
+				t.Fatalf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip;q=0.5", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"*", true},
+		{"*;q=0", false},
+		{"*, gzip;q=0", false},
+		{"identity", false},
+		{"gzipped", false},
+	}
+	for _, tt := range tests {
+		if got := acceptsGzip(tt.header); got != tt.want {
+			t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	large := strings.Repeat("compress me ", 200)
+	r := gin.New()
+	r.Use(GzipMiddleware(gzipMinSize))
+	r.GET("/large", func(c *gin.Context) {
+		c.String(http.StatusOK, large)
+	})
+	r.GET("/small", func(c *gin.Context) {
+		c.String(http.StatusOK, "tiny")
+	})
+	r.GET("/image", func(c *gin.Context) {
+		c.Data(http.StatusOK, "image/png", []byte(large))
+	})
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+		wantBody       string
+	}{
+		{"large gzip", "/large", "gzip", true, large},
+		{"large refused", "/large", "gzip;q=0", false, large},
+		{"large no header", "/large", "", false, large},
+		{"small", "/small", "gzip", false, "tiny"},
+		{"already compressed type", "/image", "gzip", false, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, tt.path, "", "Accept-Encoding", tt.acceptEncoding)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+			}
+			if vary := w.Header().Get("Vary"); vary != "Accept-Encoding" {
+				t.Errorf("Vary = %q, want Accept-Encoding", vary)
+			}
+			gotGzip := w.Header().Get("Content-Encoding") == "gzip"
+			if gotGzip != tt.wantGzip {
+				t.Fatalf("compressed = %v, want %v", gotGzip, tt.wantGzip)
+			}
+
+			body := w.Body.String()
+			if gotGzip {
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				data, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = string(data)
+			}
+			if body != tt.wantBody {
+				t.Fatalf("body has %d bytes, want %d", len(body), len(tt.wantBody))
+			}
+		})
+	}
+}
+
+func TestGetArticleETag(t *testing.T) {
+	store := newTestStore()
+	r := newTestRouter(store)
+
+	w := performRequest(r, http.MethodGet, "/articles/1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	etag := w.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("no ETag on the response")
+	}
+
+	tests := []struct {
+		name        string
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"matching etag", etag, http.StatusNotModified},
+		{"weak matching etag", "W/" + etag, http.StatusNotModified},
+		{"one of several", `"other", ` + etag, http.StatusNotModified},
+		{"wildcard", "*", http.StatusNotModified},
+		{"stale etag", `"stale"`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, "/articles/1", "", "If-None-Match", tt.ifNoneMatch)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Fatalf("304 has a body: %q", w.Body)
+			}
+		})
+	}
+
+	// Any change to the article gives it a new ETag
+	time.Sleep(time.Millisecond)
+	if _, err := store.Update(1, func(a *Article) error { a.Title = "Edited"; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	w = performRequest(r, http.MethodGet, "/articles/1", "", "If-None-Match", etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status after update = %d, want %d", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("ETag") == etag {
+		t.Fatal("ETag did not change after the update")
+	}
+}
+
+func TestCORSAllowsConditionalHeaders(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	w := performRequest(r, http.MethodOptions, "/articles/1", "", "Origin", "http://localhost:3000")
+	allowed := w.Header().Get("Access-Control-Allow-Headers")
+	for _, header := range []string{"If-Match", "If-None-Match"} {
+		if !strings.Contains(allowed, header) {
+			t.Errorf("Access-Control-Allow-Headers %q is missing %s", allowed, header)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	w := performRequest(r, http.MethodGet, "/articles/1", "", "Origin", "http://localhost:3000")
+
+	want := map[string]string{
+		"X-Content-Type-Options":      "nosniff",
+		"X-Frame-Options":             "DENY",
+		"Referrer-Policy":             "no-referrer",
+		"Content-Security-Policy":     defaultCSP,
+		"Access-Control-Allow-Origin": "http://localhost:3000",
+	}
+	for header, value := range want {
+		if got := w.Header().Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestCORSMiddlewareOrigins(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		origin  string
+		want    string
+	}{
+		{"allowed origin", []string{"https://staging.myblog.com"}, "https://staging.myblog.com", "https://staging.myblog.com"},
+		{"disallowed origin", []string{"https://staging.myblog.com"}, "https://evil.example", ""},
+		{"default origins", nil, "https://myblog.com", "https://myblog.com"},
+		{"default excludes others", nil, "https://staging.myblog.com", ""},
+		{"wildcard", []string{"*"}, "https://anything.example", "https://anything.example"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.Use(CORSMiddleware(tt.allowed))
+			r.GET("/ping", ping)
+
+			w := performRequest(r, http.MethodGet, "/ping", "", "Origin", tt.origin)
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Fatalf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			if tt.want != "" && w.Header().Get("Vary") != "Origin" {
+				t.Fatalf("Vary = %q, want Origin", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestCORSOriginsFromEnv(t *testing.T) {
+	t.Setenv("CORS_ALLOWED_ORIGINS", " https://a.example , ,https://b.example")
+	if got, want := corsOriginsFromEnv(), []string{"https://a.example", "https://b.example"}; !slices.Equal(got, want) {
+		t.Fatalf("origins = %v, want %v", got, want)
+	}
+}
+
+func TestCreateArticlesBatch(t *testing.T) {
+	valid := `{"title":"t","content":"c","author":"a"}`
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantSuccess []bool
+	}{
+		{"all valid", "[" + valid + "," + valid + "]", http.StatusCreated, []bool{true, true}},
+		{"mixed", "[" + valid + `,{"title":"no content","author":"a"},` + valid + "]", http.StatusMultiStatus, []bool{true, false, true}},
+		{"not an array", valid, http.StatusBadRequest, nil},
+		{"null", `null`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodPost, "/articles/batch", tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantSuccess == nil {
+				if resp := decodeResponse(t, w, nil); resp.Error != "request body must be a JSON array of articles" {
+					t.Fatalf("error = %q", resp.Error)
+				}
+				return
+			}
+
+			var results []struct {
+				Index   int          `json:"index"`
+				Success bool         `json:"success"`
+				Data    Article      `json:"data"`
+				Errors  []FieldError `json:"errors"`
+			}
+			decodeResponse(t, w, &results)
+			if len(results) != len(tt.wantSuccess) {
+				t.Fatalf("got %d results, want %d", len(results), len(tt.wantSuccess))
+			}
+			created := 0
+			for i, res := range results {
+				if res.Index != i || res.Success != tt.wantSuccess[i] {
+					t.Errorf("result %d = %+v, want success %v", i, res, tt.wantSuccess[i])
+				}
+				if res.Success {
+					created++
+					if res.Data.ID == 0 {
+						t.Errorf("result %d has no id", i)
+					}
+				} else if len(res.Errors) == 0 {
+					t.Errorf("result %d has no field errors", i)
+				}
+			}
+			list, _ := store.List(ArticleFilter{})
+			if len(list) != len(seedArticles)+created {
+				t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles)+created)
+			}
+		})
+	}
+}
+
+func TestSoftDeletedArticles(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	if w := performRequest(r, http.MethodDelete, "/articles/1", "", "X-API-Key", "admin-key"); w.Code != http.StatusOK {
+		t.Fatalf("delete status = %d", w.Code)
+	}
+
+	tests := []struct {
+		name        string
+		path        string
+		key         string
+		wantStatus  int
+		wantIDs     []int
+		wantDeleted bool
+	}{
+		{"normal list", "/articles?sort=title", "", http.StatusOK, []int{2}, false},
+		{"admin with deleted", "/articles?sort=title&include_deleted=true", "admin-key", http.StatusOK, []int{1, 2}, true},
+		{"user with deleted", "/articles?include_deleted=true", "user-key-456", http.StatusForbidden, nil, false},
+		{"anonymous with deleted", "/articles?include_deleted=true", "", http.StatusForbidden, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, tt.path, "", "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list []Article
+			decodeResponse(t, w, &list)
+			if got := articleIDs(list); !slices.Equal(got, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", got, tt.wantIDs)
+			}
+			if tt.wantDeleted && (!list[0].Deleted || list[0].DeletedAt == nil) {
+				t.Fatalf("article 1 = %+v, want it marked deleted", list[0])
+			}
+		})
+	}
+
+	if w := performRequest(r, http.MethodGet, "/articles/1", ""); w.Code != http.StatusNotFound {
+		t.Fatalf("get deleted article status = %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
+
+func TestRestoreArticle(t *testing.T) {
+	tests := []struct {
+		name        string
+		deleteFirst bool
+		id          string
+		key         string
+		wantStatus  int
+	}{
+		{"deleted article", true, "1", "admin-key", http.StatusOK},
+		{"not deleted", false, "1", "admin-key", http.StatusBadRequest},
+		{"unknown article", false, "99", "admin-key", http.StatusNotFound},
+		{"not an admin", true, "1", "user-key-456", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+			if tt.deleteFirst {
+				performRequest(r, http.MethodDelete, "/articles/"+tt.id, "", "X-API-Key", "admin-key")
+			}
+
+			w := performRequest(r, http.MethodPost, "/admin/articles/"+tt.id+"/restore", "", "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var restored Article
+			decodeResponse(t, w, &restored)
+			if restored.Deleted || restored.DeletedAt != nil {
+				t.Fatalf("restored article still deleted: %+v", restored)
+			}
+			if w := performRequest(r, http.MethodGet, "/articles/"+tt.id, ""); w.Code != http.StatusOK {
+				t.Fatalf("get after restore status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	performRequest(r, http.MethodGet, "/articles/1", "")
+	performRequest(r, http.MethodGet, "/articles/99", "")
+	performRequest(r, http.MethodGet, "/no/such/route", "")
+
+	w := performRequest(r, http.MethodGet, "/metrics", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	body := w.Body.String()
+	for _, want := range []string{
+		"# TYPE http_requests_total counter",
+		"# TYPE http_request_duration_seconds histogram",
+		`http_requests_total{method="GET",route="/articles/:id",status="200"}`,
+		`http_requests_total{method="GET",route="/articles/:id",status="404"}`,
+		`http_requests_total{method="GET",route="unmatched",status="404"}`,
+		`http_request_duration_seconds_bucket{method="GET",route="/articles/:id"`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output is missing %s", want)
+		}
+	}
+}
+
+func TestArticleContentNegotiation(t *testing.T) {
+	tests := []struct {
+		name     string
+		path     string
+		accept   string
+		wantType string
+	}{
+		{"json", "/articles/1", "application/json", "application/json"},
+		{"xml", "/articles/1", "application/xml", "application/xml"},
+		{"text xml", "/articles/1", "text/xml", "application/xml"},
+		{"anything", "/articles/1", "*/*", "application/json"},
+		{"no accept header", "/articles/1", "", "application/json"},
+		{"xml error", "/articles/99", "application/xml", "application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, http.MethodGet, tt.path, "", "Accept", tt.accept)
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Fatalf("Content-Type = %q, want %s", got, tt.wantType)
+			}
+
+			var resp struct {
+				XMLName xml.Name `xml:"response"`
+				Success bool     `json:"success" xml:"success"`
+				Data    Article  `json:"data" xml:"data"`
+				Error   string   `json:"error" xml:"error"`
+			}
+			unmarshal := json.Unmarshal
+			if tt.wantType == "application/xml" {
+				unmarshal = xml.Unmarshal
+			}
+			if err := unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatalf("decoding %q: %v", w.Body, err)
+			}
+			if w.Code == http.StatusNotFound {
+				if resp.Success || resp.Error != ErrArticleNotFound.Error() {
+					t.Fatalf("unexpected response %+v", resp)
+				}
+				return
+			}
+			if !resp.Success || resp.Data.ID != 1 || resp.Data.Title != seedArticles[0].Title || !slices.Equal(resp.Data.Tags, seedArticles[0].Tags) {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+// Waits until b has n subscribers, so events published afterwards reach them
+func waitForSubscribers(t *testing.T, b *articleBroker, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b.mu.Lock()
+		count := len(b.subscribers)
+		b.mu.Unlock()
+		if count == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("broker has %d subscribers, want %d", count, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStreamArticles(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(NewMemoryArticleStore(seedArticles, 0, articleEvents)))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/articles/stream", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The response headers only arrive with the first event
+	responses := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			close(responses)
+			return
+		}
+		responses <- resp
+	}()
+	waitForSubscribers(t, articleEvents, 1)
+
+	body := `{"title":"Streamed","content":"c","author":"a"}`
+	if w := performRequest(srv.Config.Handler, http.MethodPost, "/articles", body, "X-API-Key", "admin-key"); w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+
+	resp, ok := <-responses
+	if !ok {
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Type"); !strings.HasPrefix(got, "text/event-stream") {
+		t.Fatalf("Content-Type = %q, want text/event-stream", got)
+	}
+
+	var event, data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() && scanner.Text() != "" {
+		if name, ok := strings.CutPrefix(scanner.Text(), "event:"); ok {
+			event = name
+		}
+		if value, ok := strings.CutPrefix(scanner.Text(), "data:"); ok {
+			data = value
+		}
+	}
+	if event != "created" {
+		t.Fatalf("event = %q, want created", event)
+	}
+	var article Article
+	if err := json.Unmarshal([]byte(data), &article); err != nil {
+		t.Fatalf("decoding event data %q: %v", data, err)
+	}
+	if article.Title != "Streamed" || article.ID == 0 {
+		t.Fatalf("event article = %+v", article)
+	}
+
+	// Disconnecting unsubscribes the stream
+	cancel()
+	waitForSubscribers(t, articleEvents, 0)
+}
+
+func TestMemoryArticleStoreEvents(t *testing.T) {
+	broker := newArticleBroker()
+	events := broker.subscribe()
+	store := NewMemoryArticleStore(seedArticles, 0, broker)
+
+	created, err := store.Create(Article{Title: "t", Content: "c", Author: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := created[0].ID
+	store.Update(id, func(a *Article) error { a.Title = "edited"; return nil })
+	store.Delete(id)
+	store.Restore(id)
+	store.DeleteMany([]int{id, 99})
+
+	want := []string{"created", "updated", "deleted", "restored", "deleted"}
+	for _, wantType := range want {
+		select {
+		case event := <-events:
+			if event.Type != wantType || event.Article.ID != id {
+				t.Fatalf("event = %s of article %d, want %s of article %d", event.Type, event.Article.ID, wantType, id)
+			}
+		default:
+			t.Fatalf("no %s event was published", wantType)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("unexpected %s event", event.Type)
+	default:
+	}
+}
+
+func TestMemoryArticleStoreEventOrder(t *testing.T) {
+	broker := newArticleBroker()
+	events := broker.subscribe()
+	store := NewMemoryArticleStore(seedArticles, 0, broker)
+
+	// Fewer updates than the subscriber buffer holds, so none are dropped
+	const updates = 10
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			store.Update(1, func(a *Article) error { return nil })
+		}()
+	}
+	wg.Wait()
+
+	// Events are published under the store lock, so they arrive in version order
+	last := seedArticles[0].Version
+	for i := 0; i < updates; i++ {
+		event := <-events
+		if event.Article.Version != last+1 {
+			t.Fatalf("event %d has version %d, want %d", i, event.Article.Version, last+1)
+		}
+		last = event.Article.Version
+	}
+}
+
+func TestArticlesWebSocket(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(NewMemoryArticleStore(seedArticles, 0, articleEvents)))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/articles"
+
+	conn, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitForSubscribers(t, articleEvents, 1)
+
+	body := `{"title":"Pushed","content":"c","author":"a"}`
+	if w := performRequest(srv.Config.Handler, http.MethodPost, "/articles", body, "X-API-Key", "admin-key"); w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var event ArticleEvent
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Type != "created" || event.Article.Title != "Pushed" {
+		t.Fatalf("event = %+v", event)
+	}
+
+	// Closing the connection unsubscribes it
+	conn.Close()
+	waitForSubscribers(t, articleEvents, 0)
+}
+
+func TestArticlesWebSocketRejectsOtherOrigins(t *testing.T) {
+	srv := httptest.NewServer(newTestRouter(newTestStore()))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws/articles"
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"https://evil.example"}})
+	if err == nil {
+		t.Fatal("a cross-origin upgrade succeeded")
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("response = %v, want 403", resp)
+	}
+	resp.Body.Close()
+}
+
+func TestOpenAPISpec(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	w := performRequest(r, http.MethodGet, "/openapi.json", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	if !json.Valid(w.Body.Bytes()) {
+		t.Fatalf("spec is not valid JSON: %s", w.Body)
+	}
+	var spec OpenAPISpec
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("openapi = %q, want a 3.x version", spec.OpenAPI)
+	}
+	if scheme := spec.Components.SecuritySchemes["ApiKeyAuth"]; scheme.In != "header" || scheme.Name != "X-API-Key" {
+		t.Fatalf("ApiKeyAuth = %+v, want the X-API-Key header", scheme)
+	}
+
+	// Every route the router serves is documented, apart from the spec itself and the metrics
+	for _, route := range r.Routes() {
+		if route.Path == "/openapi.json" || route.Path == "/metrics" {
+			continue
+		}
+		// gin's :name parameters are {name} in OpenAPI
+		segments := strings.Split(route.Path, "/")
+		for i, segment := range segments {
+			if name, ok := strings.CutPrefix(segment, ":"); ok {
+				segments[i] = "{" + name + "}"
+			}
+		}
+		path := strings.Join(segments, "/")
+		if _, ok := spec.Paths[path][strings.ToLower(route.Method)]; !ok {
+			t.Errorf("%s %s is not in the spec", route.Method, path)
+		}
+	}
+
+	// Every schema reference points at a component
+	var checkRefs func(where string, schema OpenAPISchema)
+	checkRefs = func(where string, schema OpenAPISchema) {
+		if name, ok := strings.CutPrefix(schema.Ref, "#/components/schemas/"); ok {
+			if _, found := spec.Components.Schemas[name]; !found {
+				t.Errorf("%s refers to the missing schema %s", where, name)
+			}
+		}
+		if schema.Items != nil {
+			checkRefs(where, *schema.Items)
+		}
+		for _, property := range schema.Properties {
+			checkRefs(where, property)
+		}
+	}
+	for path, operations := range spec.Paths {
+		for method, op := range operations {
+			where := method + " " + path
+			if op.RequestBody != nil {
+				for _, media := range op.RequestBody.Content {
+					checkRefs(where, media.Schema)
+				}
+			}
+			for _, resp := range op.Responses {
+				for _, media := range resp.Content {
+					checkRefs(where, media.Schema)
+				}
+			}
+		}
+	}
+	for name, schema := range spec.Components.Schemas {
+		checkRefs(name, schema)
+	}
+
+	// PATCH bodies may leave out any field
+	patch := spec.Paths["/articles/{id}"]["patch"]
+	if ref := patch.RequestBody.Content["application/json"].Schema.Ref; ref != "#/components/schemas/ArticlePatch" {
+		t.Fatalf("PATCH body schema = %q, want ArticlePatch", ref)
+	}
+	if required := spec.Components.Schemas["ArticlePatch"].Required; len(required) != 0 {
+		t.Fatalf("ArticlePatch requires %v", required)
+	}
+}
+
+func TestIdempotentCreateArticle(t *testing.T) {
+	tests := []struct {
+		name       string
+		firstKey   string
+		secondKey  string
+		secondAuth string
+		wantSame   bool
+	}{
+		{"same key", "retry", "retry", "admin-key", true},
+		{"different keys", "one", "two", "admin-key", false},
+		{"same key from another caller", "retry", "retry", "user-key-456", false},
+		{"no key", "", "", "admin-key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+			// Recorded keys outlive the router, so each test uses its own
+			keyFor := func(key string) string {
+				if key == "" {
+					return ""
+				}
+				return t.Name() + "/" + key
+			}
+			body := `{"title":"Once","content":"c","author":"a"}`
+
+			first := performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", "admin-key", "Idempotency-Key", keyFor(tt.firstKey))
+			second := performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", tt.secondAuth, "Idempotency-Key", keyFor(tt.secondKey))
+			for _, w := range []*httptest.ResponseRecorder{first, second} {
+				if w.Code != http.StatusCreated {
+					t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+				}
+			}
+			var a, b Article
+			decodeResponse(t, first, &a)
+			decodeResponse(t, second, &b)
+			if (a.ID == b.ID) != tt.wantSame {
+				t.Fatalf("ids %d and %d, want the same article %v", a.ID, b.ID, tt.wantSame)
+			}
+			if replayed := second.Header().Get("Idempotent-Replayed") == "true"; replayed != tt.wantSame {
+				t.Fatalf("Idempotent-Replayed = %v, want %v", replayed, tt.wantSame)
+			}
+
+			want := len(seedArticles) + 2
+			if tt.wantSame {
+				want--
+			}
+			if list, _ := store.List(ArticleFilter{}); len(list) != want {
+				t.Fatalf("store has %d articles, want %d", len(list), want)
+			}
+		})
+	}
+}
+
+func TestIdempotentCreateArticleConcurrent(t *testing.T) {
+	store := newTestStore()
+	r := newTestRouter(store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := performRequest(r, http.MethodPost, "/articles", `{"title":"Once","content":"c","author":"a"}`,
+				"X-API-Key", "admin-key", "Idempotency-Key", t.Name())
+			if w.Code != http.StatusCreated {
+				t.Errorf("status = %d: %s", w.Code, w.Body)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if list, _ := store.List(ArticleFilter{}); len(list) != len(seedArticles)+1 {
+		t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles)+1)
+	}
+}
+
+func TestUpdateArticleVersioning(t *testing.T) {
+	body := func(version int) string {
+		return `{"title":"Edited","content":"c","author":"a","version":` + strconv.Itoa(version) + `}`
+	}
+	tests := []struct {
+		name       string
+		body       string
+		ifMatch    string
+		wantStatus int
+	}{
+		{"version in body", body(1), "", http.StatusOK},
+		{"version in If-Match", body(0), `"1"`, http.StatusOK},
+		{"weak If-Match", body(0), `W/"1"`, http.StatusOK},
+		{"If-Match wins over body", body(7), "1", http.StatusOK},
+		{"stale body version", body(5), "", http.StatusConflict},
+		{"stale If-Match", body(0), `"2"`, http.StatusConflict},
+		{"no version", body(0), "", http.StatusPreconditionRequired},
+		{"malformed If-Match", body(0), "latest", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodPut, "/articles/1", tt.body, "X-API-Key", "admin-key", "If-Match", tt.ifMatch)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var article Article
+			resp := decodeResponse(t, w, &article)
+			stored, _ := store.Get(1, false)
+
+			switch tt.wantStatus {
+			case http.StatusOK:
+				if article.Version != 2 || article.Title != "Edited" || stored.Version != 2 {
+					t.Fatalf("updated article = %+v, stored version %d, want version 2", article, stored.Version)
+				}
+			case http.StatusConflict:
+				// The conflict hands back the current article so the client can merge
+				if article.Version != 1 || article.Title != seedArticles[0].Title {
+					t.Fatalf("conflict data = %+v, want the stored article", article)
+				}
+				fallthrough
+			default:
+				if stored.Version != 1 || stored.Title != seedArticles[0].Title {
+					t.Fatalf("a rejected update changed the article: %+v", stored)
+				}
+				if resp.RequestID == "" || resp.RequestID != w.Header().Get("X-Request-ID") {
+					t.Fatalf("request_id = %q, want the X-Request-ID header %q", resp.RequestID, w.Header().Get("X-Request-ID"))
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateArticleLostUpdate(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	// Two clients both read version 1, the second one to write loses
+	first := performRequest(r, http.MethodPut, "/articles/1", `{"title":"First","content":"c","author":"a","version":1}`, "X-API-Key", "admin-key")
+	if first.Code != http.StatusOK {
+		t.Fatalf("first update status = %d: %s", first.Code, first.Body)
+	}
+	second := performRequest(r, http.MethodPut, "/articles/1", `{"title":"Second","content":"c","author":"a","version":1}`, "X-API-Key", "admin-key")
+	if second.Code != http.StatusConflict {
+		t.Fatalf("second update status = %d, want %d", second.Code, http.StatusConflict)
+	}
+	if resp := decodeResponse(t, second, nil); resp.Error != "article was modified, current version is 2" {
+		t.Fatalf("error = %q", resp.Error)
+	}
+}
+
+func TestArticleCategories(t *testing.T) {
+	store := newTestStore()
+	r := newTestRouter(store)
+
+	creates := []struct {
+		category   string
+		wantStatus int
+	}{
+		{"news", http.StatusCreated},
+		{"opinion", http.StatusCreated},
+		{"", http.StatusCreated},
+		{"gossip", http.StatusBadRequest},
+	}
+	for _, tt := range creates {
+		body := `{"title":"In ` + tt.category + `","content":"c","author":"a","category":"` + tt.category + `"}`
+		w := performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", "admin-key")
+		if w.Code != tt.wantStatus {
+			t.Fatalf("create in %q: status = %d, want %d: %s", tt.category, w.Code, tt.wantStatus, w.Body)
+		}
+		if tt.wantStatus == http.StatusBadRequest {
+			resp := decodeResponse(t, w, nil)
+			if len(resp.Errors) != 1 || resp.Errors[0].Field != "category" || !strings.HasPrefix(resp.Errors[0].Message, "must be one of news") {
+				t.Fatalf("errors = %+v, want one for category", resp.Errors)
+			}
+		}
+	}
+
+	filters := []struct {
+		category   string
+		wantStatus int
+		wantTitles []string
+	}{
+		{"news", http.StatusOK, []string{"In news"}},
+		{"tutorial", http.StatusOK, []string{seedArticles[0].Title, seedArticles[1].Title}},
+		{"review", http.StatusOK, []string{}},
+		{"gossip", http.StatusBadRequest, nil},
+	}
+	for _, tt := range filters {
+		t.Run(tt.category, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, "/articles?sort=title&category="+tt.category, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list []Article
+			decodeResponse(t, w, &list)
+			titles := []string{}
+			for _, a := range list {
+				titles = append(titles, a.Title)
+			}
+			if !slices.Equal(titles, tt.wantTitles) {
+				t.Fatalf("titles = %q, want %q", titles, tt.wantTitles)
+			}
+		})
+	}
+}
+
+var testJWTSecret = []byte("test-secret")
+
+// Mints a token for subject and role with the test secret, failing the test on error
+func mustJWT(t *testing.T, secret []byte, subject, role string, ttl time.Duration) string {
+	t.Helper()
+	token, err := NewJWT(secret, subject, role, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTAuthMiddleware(t *testing.T) {
+	user := mustJWT(t, testJWTSecret, "alice", "user", time.Hour)
+	admin := mustJWT(t, testJWTSecret, "alice", "admin", time.Hour)
+	// The claims of the admin token under the signature of the user token
+	userParts, adminParts := strings.Split(user, "."), strings.Split(admin, ".")
+	tampered := userParts[0] + "." + adminParts[1] + "." + userParts[2]
+	unsigned, err := jwt.NewWithClaims(jwt.SigningMethodNone, jwtClaims{
+		Role:             "admin",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noExpiry, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwtClaims{Role: "admin"}).SignedString(testJWTSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		header     string
+		wantStatus int
+		wantError  string
+	}{
+		{"valid", "Bearer " + user, http.StatusOK, ""},
+		{"expired", "Bearer " + mustJWT(t, testJWTSecret, "alice", "user", -time.Minute), http.StatusUnauthorized, "token has expired"},
+		{"tampered", "Bearer " + tampered, http.StatusUnauthorized, "invalid token"},
+		{"wrong secret", "Bearer " + mustJWT(t, []byte("other"), "alice", "admin", time.Hour), http.StatusUnauthorized, "invalid token"},
+		{"unsigned", "Bearer " + unsigned, http.StatusUnauthorized, "invalid token"},
+		{"no expiry", "Bearer " + noExpiry, http.StatusUnauthorized, "invalid token"},
+		{"no role", "Bearer " + mustJWT(t, testJWTSecret, "alice", "", time.Hour), http.StatusUnauthorized, "invalid token"},
+		{"not a bearer token", "Basic " + user, http.StatusUnauthorized, "missing bearer token"},
+		{"missing", "", http.StatusUnauthorized, "missing bearer token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/whoami", JWTAuthMiddleware(testJWTSecret), func(c *gin.Context) {
+				c.String(http.StatusOK, c.GetString("role")+" "+c.GetString("principal"))
+			})
+
+			w := performRequest(r, http.MethodGet, "/whoami", "", "Authorization", tt.header)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if w.Body.String() != "user jwt:alice" {
+					t.Fatalf("role and principal = %q, want user jwt:alice", w.Body)
+				}
+				return
+			}
+			if resp := decodeResponse(t, w, nil); resp.Error != tt.wantError {
+				t.Fatalf("error = %q, want %q", resp.Error, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestRouterAcceptsBearerTokens(t *testing.T) {
+	admin := "Bearer " + mustJWT(t, testJWTSecret, "alice", "admin", time.Hour)
+	user := "Bearer " + mustJWT(t, testJWTSecret, "bob", "user", time.Hour)
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		headers    []string
+		wantStatus int
+		wantLimit  string
+	}{
+		{"create with a token", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a"}`, []string{"Authorization", user}, http.StatusCreated, "100"},
+		{"create with an API key", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a"}`, []string{"X-API-Key", "user-key-456"}, http.StatusCreated, "100"},
+		{"bad token beats a good key", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a"}`, []string{"Authorization", "Bearer nope", "X-API-Key", "admin-key"}, http.StatusUnauthorized, ""},
+		{"admin route with a token", http.MethodGet, "/admin/stats", "", []string{"Authorization", admin}, http.StatusOK, "300"},
+		{"admin route with a user token", http.MethodGet, "/admin/stats", "", []string{"Authorization", user}, http.StatusForbidden, "100"},
+		{"public route knows the token's role", http.MethodGet, "/articles?include_deleted=true", "", []string{"Authorization", admin}, http.StatusOK, "300"},
+		{"public route with a bad token", http.MethodGet, "/articles", "", []string{"Authorization", "Bearer nope"}, http.StatusOK, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRouter(routerConfig{
+				store:      newTestStore(),
+				keys:       NewMemoryKeyStore(defaultAPIKeys),
+				jwtSecret:  testJWTSecret,
+				logOutput:  io.Discard,
+				rateLimits: defaultRateLimitTiers,
+			})
+
+			w := performRequest(r, tt.method, tt.path, tt.body, tt.headers...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("X-RateLimit-Limit"); got != tt.wantLimit {
+				t.Fatalf("X-RateLimit-Limit = %q, want %q", got, tt.wantLimit)
+			}
+		})
+	}
+}
+
+func TestAPIKeyRotation(t *testing.T) {
+	r := newTestRouter(newTestStore())
+	create := `{"title":"t","content":"c","author":"a"}`
+
+	if w := performRequest(r, http.MethodPost, "/articles", create, "X-API-Key", "rotated-key"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("unknown key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	w := performRequest(r, http.MethodPost, "/admin/keys", `{"key":"rotated-key","role":"user"}`, "X-API-Key", "admin-key")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("add status = %d: %s", w.Code, w.Body)
+	}
+	if w := performRequest(r, http.MethodPost, "/articles", create, "X-API-Key", "rotated-key"); w.Code != http.StatusCreated {
+		t.Fatalf("added key: status = %d, want %d", w.Code, http.StatusCreated)
+	}
+
+	w = performRequest(r, http.MethodDelete, "/admin/keys/rotated-key", "", "X-API-Key", "admin-key")
+	if w.Code != http.StatusOK {
+		t.Fatalf("revoke status = %d: %s", w.Code, w.Body)
+	}
+	if w := performRequest(r, http.MethodPost, "/articles", create, "X-API-Key", "rotated-key"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("revoked key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	// Generated keys are handed back to the admin
+	w = performRequest(r, http.MethodPost, "/admin/keys", `{"role":"admin"}`, "X-API-Key", "admin-key")
+	var generated APIKeyInput
+	decodeResponse(t, w, &generated)
+	if w.Code != http.StatusCreated || generated.Key == "" || generated.Role != "admin" {
+		t.Fatalf("generate status = %d, key = %+v", w.Code, generated)
+	}
+	if w := performRequest(r, http.MethodGet, "/admin/stats", "", "X-API-Key", generated.Key); w.Code != http.StatusOK {
+		t.Fatalf("generated admin key: status = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestAPIKeyAdminErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		key        string
+		wantStatus int
+	}{
+		{"add as a user", http.MethodPost, "/admin/keys", `{"key":"k","role":"user"}`, "user-key-456", http.StatusForbidden},
+		{"add with an unknown role", http.MethodPost, "/admin/keys", `{"key":"k","role":"root"}`, "admin-key", http.StatusBadRequest},
+		{"add an existing key", http.MethodPost, "/admin/keys", `{"key":"user-key-456","role":"admin"}`, "admin-key", http.StatusConflict},
+		{"revoke as a user", http.MethodDelete, "/admin/keys/admin-key", "", "user-key-456", http.StatusForbidden},
+		{"revoke an unknown key", http.MethodDelete, "/admin/keys/nope", "", "admin-key", http.StatusNotFound},
+		{"revoke the last admin key", http.MethodDelete, "/admin/keys/admin-key", "", "admin-key", http.StatusConflict},
+		{"revoke without a key", http.MethodDelete, "/admin/keys", "", "admin-key", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys := NewMemoryKeyStore(defaultAPIKeys)
+			r := newRouter(routerConfig{store: newTestStore(), keys: keys, logOutput: io.Discard, rateLimits: defaultRateLimitTiers})
+
+			w := performRequest(r, tt.method, tt.path, tt.body, "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if resp := decodeResponse(t, w, nil); resp.RequestID == "" {
+				t.Fatalf("error response has no request_id: %s", w.Body)
+			}
+			for key, role := range defaultAPIKeys {
+				if got, ok := keys.Lookup(key); !ok || got != role {
+					t.Fatalf("key %s changed to %q, %v", key, got, ok)
+				}
+			}
+		})
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		wantAllow []string
+	}{
+		{"post to ping", http.MethodPost, "/ping", []string{"GET"}},
+		{"put to the list", http.MethodPut, "/articles", []string{"GET", "POST", "DELETE"}},
+		{"post to an article", http.MethodPost, "/articles/1", []string{"GET", "HEAD", "PUT", "PATCH", "DELETE"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, tt.method, tt.path, "", "X-API-Key", "admin-key")
+			if w.Code != http.StatusMethodNotAllowed {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+			}
+			allow := strings.Split(w.Header().Get("Allow"), ", ")
+			slices.Sort(allow)
+			want := slices.Sorted(slices.Values(tt.wantAllow))
+			if !slices.Equal(allow, want) {
+				t.Fatalf("Allow = %q, want %q", allow, want)
+			}
+			resp := decodeResponse(t, w, nil)
+			if resp.Success || resp.Error != "method "+tt.method+" not allowed" || resp.RequestID == "" {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+		})
+	}
+}
+
+func TestNotFoundRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		accept string
+	}{
+		{"unknown path", http.MethodGet, "/no/such/route", ""},
+		{"unknown nested article path", http.MethodGet, "/articles/1/comments", ""},
+		{"xml client", http.MethodGet, "/no/such/route", "application/xml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, tt.method, tt.path, "", "Accept", tt.accept)
+			if w.Code != http.StatusNotFound {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusNotFound)
+			}
+			var resp Response
+			if tt.accept == "application/xml" {
+				if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+					t.Fatalf("decoding %q: %v", w.Body, err)
+				}
+			} else {
+				resp = decodeResponse(t, w, nil)
+			}
+			if resp.Success || resp.Error != "route not found" {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+			if resp.RequestID == "" || resp.RequestID != w.Header().Get("X-Request-ID") {
+				t.Fatalf("request_id = %q, want the X-Request-ID header %q", resp.RequestID, w.Header().Get("X-Request-ID"))
+			}
+		})
+	}
+}
+
+func TestHandlerLogsCarryRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{"incoming id", "trace-123"},
+		{"generated id", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			r := newRouter(routerConfig{
+				store:      newTestStore(),
+				keys:       NewMemoryKeyStore(defaultAPIKeys),
+				logOutput:  &logs,
+				jsonLogs:   true,
+				rateLimits: defaultRateLimitTiers,
+			})
+
+			w := performRequest(r, http.MethodPost, "/articles", `{"title":"Logged","content":"c","author":"a"}`,
+				"X-API-Key", "admin-key", "X-Request-ID", tt.requestID)
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			wantID := w.Header().Get("X-Request-ID")
+			if tt.requestID != "" && wantID != tt.requestID {
+				t.Fatalf("X-Request-ID = %q, want %q", wantID, tt.requestID)
+			}
+
+			// The handler's line shares the sink with the request log
+			var found bool
+			for _, raw := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+				var line struct {
+					Msg       string `json:"msg"`
+					RequestID string `json:"request_id"`
+					ArticleID int    `json:"article_id"`
+				}
+				if err := json.Unmarshal([]byte(raw), &line); err != nil {
+					t.Fatalf("decoding log line %q: %v", raw, err)
+				}
+				if line.Msg == "article created" {
+					found = true
+					if line.RequestID != wantID || line.ArticleID == 0 {
+						t.Fatalf("log line = %+v, want request_id %q and an article_id", line, wantID)
+					}
+				}
+			}
+			if !found {
+				t.Fatalf("no article created line in %q", logs.String())
+			}
+		})
+	}
+}
+
+func TestLoggerWritesToInjectedSink(t *testing.T) {
+	var sink bytes.Buffer
+	r := gin.New()
+	r.Use(RequestIDMiddleware(slog.New(slog.NewTextHandler(&sink, nil))))
+	r.GET("/logged", func(c *gin.Context) {
+		Logger(c).Info("handled", "answer", 42)
+		c.Status(http.StatusNoContent)
+	})
+
+	performRequest(r, http.MethodGet, "/logged", "", "X-Request-ID", "req-logged")
+	if line := sink.String(); !strings.Contains(line, "msg=handled request_id=req-logged answer=42") {
+		t.Fatalf("sink = %q, want the handler's line tagged with its request id", line)
+	}
+}
+
+func TestGetVersion(t *testing.T) {
+	defer func(v, c, b string) { version, gitCommit, buildTime = v, c, b }(version, gitCommit, buildTime)
+	version, gitCommit, buildTime = "1.2.0", "abc123", "2026-01-02T03:04:05Z"
+
+	w := performRequest(newTestRouter(newTestStore()), http.MethodGet, "/version", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusOK)
+	}
+	var info map[string]string
+	decodeResponse(t, w, &info)
+	want := map[string]string{"version": "1.2.0", "git_commit": "abc123", "build_time": "2026-01-02T03:04:05Z"}
+	if !maps.Equal(info, want) {
+		t.Fatalf("build info = %v, want %v", info, want)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		incoming string
+		wantKept bool
+	}{
+		{"incoming id", "upstream-req.42:a_b", true},
+		{"uuid", "0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11", true},
+		{"absent", "", false},
+		{"unsafe characters", "id with spaces\n", false},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"longest allowed", strings.Repeat("a", maxRequestIDLength), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			r := newRouter(routerConfig{store: newTestStore(), keys: NewMemoryKeyStore(defaultAPIKeys), logOutput: &logs, rateLimits: defaultRateLimitTiers})
+
+			w := performRequest(r, http.MethodGet, "/ping", "", "X-Request-ID", tt.incoming)
+			got := w.Header().Get("X-Request-ID")
+			if tt.wantKept {
+				if got != tt.incoming {
+					t.Fatalf("X-Request-ID = %q, want the incoming %q", got, tt.incoming)
+				}
+			} else if _, err := uuid.Parse(got); err != nil {
+				t.Fatalf("X-Request-ID = %q, want a generated UUID", got)
+			}
+
+			if resp := decodeResponse(t, w, nil); resp.RequestID != got {
+				t.Fatalf("request_id = %q, want %q", resp.RequestID, got)
+			}
+			if !strings.Contains(logs.String(), "["+got+"]") {
+				t.Fatalf("request log %q does not mention %s", logs.String(), got)
+			}
+		})
+	}
+}
+
+func TestArticleFieldLengths(t *testing.T) {
+	article := func(title, content, author string) string {
+		data, _ := json.Marshal(map[string]string{"title": title, "content": content, "author": author})
+		return string(data)
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantField  string
+		wantMsg    string
+	}{
+		{"title at the limit", article(strings.Repeat("t", maxTitleLength), "c", "a"), http.StatusCreated, "", ""},
+		{"title counted in characters", article(strings.Repeat("é", maxTitleLength), "c", "a"), http.StatusCreated, "", ""},
+		{"title too long", article(strings.Repeat("t", maxTitleLength+1), "c", "a"), http.StatusBadRequest, "title", "must be at most 200 characters"},
+		{"author at the limit", article("t", "c", strings.Repeat("a", maxAuthorLength)), http.StatusCreated, "", ""},
+		{"author too long", article("t", "c", strings.Repeat("a", maxAuthorLength+1)), http.StatusBadRequest, "author", "must be at most 100 characters"},
+		{"content at the limit", article("t", strings.Repeat("c", maxContentLength), "a"), http.StatusCreated, "", ""},
+		{"content too long", article("t", strings.Repeat("c", maxContentLength+1), "a"), http.StatusBadRequest, "content", "must be at most 50000 characters"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, http.MethodPost, "/articles", tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %.200s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusBadRequest {
+				return
+			}
+			resp := decodeResponse(t, w, nil)
+			want := []FieldError{{Field: tt.wantField, Message: tt.wantMsg}}
+			if !slices.Equal(resp.Errors, want) {
+				t.Fatalf("errors = %+v, want %+v", resp.Errors, want)
+			}
+		})
+	}
+}
+
+func TestCreateArticleLocation(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	w := performRequest(r, http.MethodPost, "/articles", `{"title":"Located","content":"c","author":"a"}`, "X-API-Key", "admin-key")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var created Article
+	decodeResponse(t, w, &created)
+	location := w.Header().Get("Location")
+	if want := "/articles/" + strconv.Itoa(created.ID); location != want {
+		t.Fatalf("Location = %q, want %q", location, want)
+	}
+
+	// The header points at the new article
+	w = performRequest(r, http.MethodGet, location, "")
+	var fetched Article
+	decodeResponse(t, w, &fetched)
+	if w.Code != http.StatusOK || fetched.Title != "Located" {
+		t.Fatalf("GET %s: status %d, article %+v", location, w.Code, fetched)
+	}
+}
+
+func TestMemoryArticleStore(t *testing.T) {
+	testArticleStore(t, func(t *testing.T, events *articleBroker) ArticleStore {
+		return NewMemoryArticleStore(nil, 0, events)
+	})
+}
+
+// Checks the behaviour every ArticleStore shares. newStore returns an empty
+// store publishing to events.
+func testArticleStore(t *testing.T, newStore func(t *testing.T, events *articleBroker) ArticleStore) {
+	// Creates the articles, failing the test on error
+	create := func(t *testing.T, store ArticleStore, articles ...Article) []Article {
+		t.Helper()
+		created, err := store.Create(articles...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return created
+	}
+
+	t.Run("create", func(t *testing.T) {
+		store := newStore(t, nil)
+		tags := []string{"go"}
+		before := time.Now().Add(-time.Second)
+		created := create(t, store,
+			Article{ID: 42, Title: "First", Content: "c", Author: "a", Tags: tags, Deleted: true, Version: 9},
+			Article{Title: "Second", Content: "c", Author: "a"},
+		)
+		tags[0] = "changed"
+
+		if created[0].ID == 42 || created[1].ID <= created[0].ID {
+			t.Fatalf("ids = %d, %d, want new increasing ids", created[0].ID, created[1].ID)
+		}
+		for _, a := range created {
+			if a.Version != 1 || a.Deleted || a.DeletedAt != nil || a.CreatedAt.Before(before) || !a.UpdatedAt.Equal(a.CreatedAt) {
+				t.Fatalf("created article = %+v, want version 1, live, with fresh timestamps", a)
+			}
+		}
+		got, err := store.Get(created[0].ID, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Title != "First" || !slices.Equal(got.Tags, []string{"go"}) {
+			t.Fatalf("stored article = %+v, want the caller's slice not shared", got)
+		}
+		if _, err := store.Get(created[1].ID+1, false); !errors.Is(err, ErrArticleNotFound) {
+			t.Fatalf("Get of an unknown id: err = %v, want %v", err, ErrArticleNotFound)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		store := newStore(t, nil)
+		created := create(t, store,
+			Article{Title: "Go basics", Content: "c", Author: "Alice", Category: "tutorial", Tags: []string{"go"}},
+			Article{Title: "Opinions", Content: "about GO", Author: "bob", Category: "opinion"},
+			Article{Title: "Gone", Content: "c", Author: "alice", Tags: []string{"go", "gin"}},
+		)
+		if _, err := store.Delete(created[2].ID); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name   string
+			filter ArticleFilter
+			want   []int
+		}{
+			{"everything live", ArticleFilter{}, []int{created[0].ID, created[1].ID}},
+			{"with deleted", ArticleFilter{IncludeDeleted: true}, articleIDs(created)},
+			{"author ignores case", ArticleFilter{Author: "ALICE", IncludeDeleted: true}, []int{created[0].ID, created[2].ID}},
+			{"query in title or content", ArticleFilter{Query: "go"}, []int{created[0].ID, created[1].ID}},
+			{"category", ArticleFilter{Category: "opinion"}, []int{created[1].ID}},
+			{"tag", ArticleFilter{Tag: "gin", IncludeDeleted: true}, []int{created[2].ID}},
+			{"no match", ArticleFilter{Author: "carol"}, []int{}},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				list, err := store.List(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := articleIDs(list); !slices.Equal(got, tt.want) {
+					t.Fatalf("ids = %v, want %v", got, tt.want)
+				}
+			})
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		events := newArticleBroker()
+		sub := events.subscribe()
+		store := newStore(t, events)
+		original := create(t, store, Article{Title: "Before", Content: "c", Author: "a"})[0]
+		<-sub
+
+		updated, err := store.Update(original.ID, func(a *Article) error {
+			a.ID = 99
+			a.Title = "After"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated.ID != original.ID || updated.Title != "After" || updated.Version != 2 || updated.UpdatedAt.Before(original.UpdatedAt) {
+			t.Fatalf("updated article = %+v", updated)
+		}
+		if event := <-sub; event.Type != "updated" || event.Article.Version != 2 {
+			t.Fatalf("event = %+v, want the update", event)
+		}
+
+		errAbort := errors.New("abort")
+		if _, err := store.Update(original.ID, func(a *Article) error {
+			a.Title = "Lost"
+			return errAbort
+		}); !errors.Is(err, errAbort) {
+			t.Fatalf("err = %v, want the error from fn", err)
+		}
+		if got, _ := store.Get(original.ID, false); got.Title != "After" || got.Version != 2 {
+			t.Fatalf("an aborted update changed the article: %+v", got)
+		}
+		if _, err := store.Update(original.ID+1, func(*Article) error { return nil }); !errors.Is(err, ErrArticleNotFound) {
+			t.Fatalf("unknown id: err = %v, want %v", err, ErrArticleNotFound)
+		}
+		select {
+		case event := <-sub:
+			t.Fatalf("failed updates published %+v", event)
+		default:
+		}
+	})
+
+	t.Run("delete and restore", func(t *testing.T) {
+		store := newStore(t, nil)
+		created := create(t, store,
+			Article{Title: "One", Content: "c", Author: "a"},
+			Article{Title: "Two", Content: "c", Author: "a"},
+			Article{Title: "Three", Content: "c", Author: "a"},
+		)
+		id := created[0].ID
+		modified, _ := store.LastModified()
+
+		if _, err := store.Restore(id); !errors.Is(err, ErrArticleNotDeleted) {
+			t.Fatalf("restoring a live article: err = %v, want %v", err, ErrArticleNotDeleted)
+		}
+		deleted, err := store.Delete(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !deleted.Deleted || deleted.DeletedAt == nil {
+			t.Fatalf("deleted article = %+v, want it marked deleted", deleted)
+		}
+		if _, err := store.Get(id, false); !errors.Is(err, ErrArticleNotFound) {
+			t.Fatalf("Get of a deleted article: err = %v, want %v", err, ErrArticleNotFound)
+		}
+		if _, err := store.Get(id, true); err != nil {
+			t.Fatalf("Get of a deleted article with includeDeleted: %v", err)
+		}
+		if _, err := store.Delete(id); !errors.Is(err, ErrArticleNotFound) {
+			t.Fatalf("deleting twice: err = %v, want %v", err, ErrArticleNotFound)
+		}
+		if last, _ := store.LastModified(); last.Before(modified) {
+			t.Fatalf("LastModified went back from %v to %v", modified, last)
+		}
+
+		restored, err := store.Restore(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if restored.Deleted || restored.DeletedAt != nil {
+			t.Fatalf("restored article = %+v, want it live", restored)
+		}
+		if _, err := store.Restore(created[2].ID + 1); !errors.Is(err, ErrArticleNotFound) {
+			t.Fatalf("restoring an unknown id: err = %v, want %v", err, ErrArticleNotFound)
+		}
+
+		// Unknown and already deleted ids are skipped
+		if _, err := store.Delete(created[1].ID); err != nil {
+			t.Fatal(err)
+		}
+		many, err := store.DeleteMany([]int{created[0].ID, created[1].ID, created[2].ID, created[2].ID + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := articleIDs(many); !slices.Equal(got, []int{created[0].ID, created[2].ID}) {
+			t.Fatalf("DeleteMany deleted %v, want %v", got, []int{created[0].ID, created[2].ID})
+		}
+		if list, _ := store.List(ArticleFilter{}); len(list) != 0 {
+			t.Fatalf("%d articles are still live", len(list))
+		}
+	})
+}
+
+func TestGetArticlesFields(t *testing.T) {
+	tests := []struct {
+		name     string
+		fields   string
+		wantKeys []string
+	}{
+		{"subset", "id,title", []string{"id", "title"}},
+		{"spaces and unknown names", " title , id,titel", []string{"id", "title"}},
+		{"zero values are kept", "id,deleted,tags", []string{"deleted", "id", "tags"}},
+		{"only unknown names", "titel", nil},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, http.MethodGet, "/articles?fields="+url.QueryEscape(tt.fields), "")
+			var list []map[string]json.RawMessage
+			decodeResponse(t, w, &list)
+			if w.Code != http.StatusOK || len(list) != len(seedArticles) {
+				t.Fatalf("status %d, %d articles", w.Code, len(list))
+			}
+			for _, a := range list {
+				keys := slices.Sorted(maps.Keys(a))
+				// Without a usable field name the full articles come back
+				if tt.wantKeys == nil {
+					if !slices.Contains(keys, "content") {
+						t.Fatalf("keys %v, want the full article", keys)
+					}
+					continue
+				}
+				if !slices.Equal(keys, tt.wantKeys) {
+					t.Fatalf("keys %v, want %v", keys, tt.wantKeys)
+				}
+			}
+		})
+	}
+}
+
+func TestGetArticlesFieldsXML(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	w := performRequest(r, http.MethodGet, "/articles?fields=title,id", "", "Accept", "application/xml")
+	var resp struct {
+		Data []struct {
+			Inner string `xml:",innerxml"`
+		} `xml:"data"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	if w.Code != http.StatusOK || len(resp.Data) != len(seedArticles) {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+	// Each article holds just its fields, written in name order
+	var want []string
+	for _, a := range seedArticles {
+		want = append(want, "<id>"+strconv.Itoa(a.ID)+"</id><title>"+a.Title+"</title>")
+	}
+	for _, a := range resp.Data {
+		if !slices.Contains(want, a.Inner) {
+			t.Fatalf("article %q, want one of %q", a.Inner, want)
+		}
+	}
+}
+
+func TestHeadArticle(t *testing.T) {
+	store := newTestStore()
+	if _, err := store.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	r := newTestRouter(store)
+	etag := performRequest(r, http.MethodGet, "/articles/1", "").Header().Get("ETag")
+
+	tests := []struct {
+		name        string
+		path        string
+		ifNoneMatch string
+		wantStatus  int
+		wantETag    string
+	}{
+		{"present", "/articles/1", "", http.StatusOK, etag},
+		{"matching etag", "/articles/1", etag, http.StatusNotModified, etag},
+		{"absent", "/articles/99", "", http.StatusNotFound, ""},
+		{"soft deleted", "/articles/2", "", http.StatusNotFound, ""},
+		{"not a number", "/articles/abc", "", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodHead, tt.path, "", "If-None-Match", tt.ifNoneMatch)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if w.Body.Len() != 0 {
+				t.Fatalf("HEAD has a body: %q", w.Body)
+			}
+			// The same ETag a GET would send
+			if got := w.Header().Get("ETag"); got != tt.wantETag {
+				t.Fatalf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	// Two requests fit in the bucket, which refills one token every 100ms
+	tiers := map[string]RateLimitTier{anonymousRole: {RPS: 10, Burst: 2}}
+	r := gin.New()
+	r.Use(RateLimitMiddleware(tiers, time.Minute, time.Minute))
+	r.GET("/ping", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	tests := []struct {
+		name          string
+		wantStatus    int
+		wantRemaining string
+	}{
+		{"first", http.StatusOK, "1"},
+		{"second", http.StatusOK, "0"},
+		{"exhausted", http.StatusTooManyRequests, "0"},
+		{"still exhausted", http.StatusTooManyRequests, "0"},
+	}
+	for _, tt := range tests {
+		start := time.Now().Unix()
+		w := performRequest(r, http.MethodGet, "/ping", "")
+		if w.Code != tt.wantStatus {
+			t.Fatalf("%s: status = %d, want %d", tt.name, w.Code, tt.wantStatus)
+		}
+		if got := w.Header().Get("X-RateLimit-Limit"); got != "2" {
+			t.Fatalf("%s: X-RateLimit-Limit = %q, want 2", tt.name, got)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != tt.wantRemaining {
+			t.Fatalf("%s: X-RateLimit-Remaining = %q, want %s", tt.name, got, tt.wantRemaining)
+		}
+		// The bucket is full again within 200ms, which rounds up to at most the second after next
+		reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil || reset < start || reset > time.Now().Unix()+2 {
+			t.Fatalf("%s: X-RateLimit-Reset = %q, want a unix time under a second away", tt.name, w.Header().Get("X-RateLimit-Reset"))
+		}
+
+		retryAfter := w.Header().Get("Retry-After")
+		if tt.wantStatus == http.StatusOK {
+			if retryAfter != "" {
+				t.Fatalf("%s: Retry-After = %q on an allowed request", tt.name, retryAfter)
+			}
+			continue
+		}
+		// Delays below a second are rounded up, never down to zero
+		if seconds, err := strconv.Atoi(retryAfter); err != nil || seconds != 1 {
+			t.Fatalf("%s: Retry-After = %q, want 1", tt.name, retryAfter)
+		}
+	}
+
+	// Rejected requests don't use up tokens, so waiting for one refill is enough
+	time.Sleep(150 * time.Millisecond)
+	if w := performRequest(r, http.MethodGet, "/ping", ""); w.Code != http.StatusOK {
+		t.Fatalf("status after waiting = %d, want %d", w.Code, http.StatusOK)
+	}
+}
+
+func TestArticleLimit(t *testing.T) {
+	// Room for one more article next to the two seeded ones
+	store := NewMemoryArticleStore(seedArticles, len(seedArticles)+1, nil)
+	r := newTestRouter(store)
+	article := `{"title":"t","content":"c","author":"a"}`
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"batch too big", http.MethodPost, "/articles/batch", "[" + article + "," + article + "]", http.StatusInsufficientStorage},
+		{"fills the cap", http.MethodPost, "/articles", article, http.StatusCreated},
+		{"over the cap", http.MethodPost, "/articles", article, http.StatusInsufficientStorage},
+		{"batch over the cap", http.MethodPost, "/articles/batch", "[" + article + "]", http.StatusInsufficientStorage},
+		{"delete", http.MethodDelete, "/articles/3", "", http.StatusOK},
+		// Soft-deleted articles still take up room
+		{"over the cap after delete", http.MethodPost, "/articles", article, http.StatusInsufficientStorage},
+	}
+	for _, step := range steps {
+		w := performRequest(r, step.method, step.path, step.body, "X-API-Key", "admin-key")
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantStatus == http.StatusInsufficientStorage {
+			resp := decodeResponse(t, w, nil)
+			if resp.Success || resp.Error != ErrArticleLimit.Error() {
+				t.Fatalf("%s: unexpected response %+v", step.name, resp)
+			}
+		}
+	}
+
+	list, _ := store.List(ArticleFilter{IncludeDeleted: true})
+	if len(list) != len(seedArticles)+1 {
+		t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles)+1)
+	}
+}
+
+func TestMaxArticlesFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    int
+		wantErr bool
+	}{
+		{"", defaultMaxArticles, false},
+		{"5", 5, false},
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"many", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("MAX_ARTICLES", tt.value)
+			got, err := maxArticlesFromEnv()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("maxArticlesFromEnv() = %d, %v; want %d, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestOptionsAllowedMethods(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		wantStatus  int
+		wantMethods []string
+	}{
+		{"ping", "/ping", http.StatusNoContent, []string{"GET", "OPTIONS"}},
+		{"article list", "/articles", http.StatusNoContent, []string{"GET", "POST", "DELETE", "OPTIONS"}},
+		{"one article", "/articles/1", http.StatusNoContent, []string{"GET", "HEAD", "PUT", "PATCH", "DELETE", "OPTIONS"}},
+		{"restore", "/admin/articles/1/restore", http.StatusNoContent, []string{"POST", "OPTIONS"}},
+		{"unknown path", "/nope", http.StatusNotFound, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, http.MethodOptions, tt.path, "",
+				"Origin", "http://localhost:3000", "Access-Control-Request-Method", http.MethodGet)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			header := w.Header().Get("Access-Control-Allow-Methods")
+			if tt.wantMethods == nil {
+				if header != "" {
+					t.Fatalf("Access-Control-Allow-Methods = %q on an unknown path", header)
+				}
+				return
+			}
+			if allow := w.Header().Get("Allow"); allow != header {
+				t.Fatalf("Allow = %q, want it to match Access-Control-Allow-Methods %q", allow, header)
+			}
+			methods := strings.Split(header, ", ")
+			slices.Sort(methods)
+			if want := slices.Sorted(slices.Values(tt.wantMethods)); !slices.Equal(methods, want) {
+				t.Fatalf("Access-Control-Allow-Methods = %q, want %q", methods, want)
+			}
+		})
+	}
+}
+
+func TestArticleValidationErrors(t *testing.T) {
+	tooManyTags := make([]string, maxTags+1)
+	for i := range tooManyTags {
+		tooManyTags[i] = "tag" + strconv.Itoa(i)
+	}
+	article := func(fields map[string]interface{}) string {
+		data, _ := json.Marshal(fields)
+		return string(data)
+	}
+	tests := []struct {
+		name       string
+		body       string
+		wantErrors []FieldError
+	}{
+		{"empty article", `{}`, []FieldError{
+			{Field: "title", Message: "is required"},
+			{Field: "content", Message: "is required"},
+			{Field: "author", Message: "is required"},
+		}},
+		{"blank fields and a long title", article(map[string]interface{}{
+			"title": strings.Repeat("t", maxTitleLength+1), "content": "  ", "author": "a",
+		}), []FieldError{
+			{Field: "title", Message: "must be at most 200 characters"},
+			{Field: "content", Message: "is required"},
+		}},
+		{"bad category and too many tags", article(map[string]interface{}{
+			"title": "t", "content": "c", "author": "a", "category": "gossip", "tags": tooManyTags,
+		}), []FieldError{
+			{Field: "category", Message: "must be one of " + strings.Join(articleCategories, ", ")},
+			{Field: "tags", Message: "must have at most 20 items"},
+		}},
+		{"bad tags", article(map[string]interface{}{
+			"title": "t", "content": "c", "author": "a", "tags": []string{strings.Repeat("x", maxTagLength+1), "ok", ""},
+		}), []FieldError{
+			{Field: "tags[0]", Message: "must be at most 50 characters"},
+			{Field: "tags[2]", Message: "is required"},
+		}},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{http.MethodPost, http.MethodPut} {
+			t.Run(tt.name+" "+method, func(t *testing.T) {
+				store := newTestStore()
+				r := newTestRouter(store)
+				path := "/articles"
+				if method == http.MethodPut {
+					path = "/articles/1"
+				}
+
+				w := performRequest(r, method, path, tt.body, "X-API-Key", "admin-key")
+				if w.Code != http.StatusBadRequest {
+					t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusBadRequest, w.Body)
+				}
+				resp := decodeResponse(t, w, nil)
+				if resp.Error != "validation failed" || !slices.Equal(resp.Errors, tt.wantErrors) {
+					t.Fatalf("error %q, errors %+v; want %+v", resp.Error, resp.Errors, tt.wantErrors)
+				}
+				if list, _ := store.List(ArticleFilter{}); !slices.EqualFunc(list, seedArticles, func(a, b Article) bool { return a.Title == b.Title }) {
+					t.Fatalf("store changed: %+v", list)
+				}
+			})
+		}
+	}
+}
+
+func TestArticleValidationErrorsXML(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	var resp struct {
+		Errors []FieldError `xml:"errors>error"`
+	}
+	w := performRequest(r, http.MethodPost, "/articles", `{"title":"t"}`, "X-API-Key", "admin-key", "Accept", "application/xml")
+	if err := xml.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding %q: %v", w.Body, err)
+	}
+	want := []FieldError{{Field: "content", Message: "is required"}, {Field: "author", Message: "is required"}}
+	if w.Code != http.StatusBadRequest || !slices.Equal(resp.Errors, want) {
+		t.Fatalf("status %d, errors %+v; want %+v", w.Code, resp.Errors, want)
+	}
+
+	// Responses without field errors have no errors element at all
+	w = performRequest(r, http.MethodGet, "/articles/1", "", "Accept", "application/xml")
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<errors") {
+		t.Fatalf("status %d, body %s", w.Code, w.Body)
+	}
+}
+
+func TestPatchArticleValidationErrors(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	// The patched article is checked against the same rules as a bound one
+	w := performRequest(r, http.MethodPatch, "/articles/1", `{"title":" ","category":"gossip"}`, "X-API-Key", "admin-key")
+	resp := decodeResponse(t, w, nil)
+	want := []FieldError{
+		{Field: "title", Message: "is required"},
+		{Field: "category", Message: "must be one of " + strings.Join(articleCategories, ", ")},
+	}
+	if w.Code != http.StatusBadRequest || !slices.Equal(resp.Errors, want) {
+		t.Fatalf("status %d, errors %+v; want %+v", w.Code, resp.Errors, want)
+	}
+}
+
+func TestCreateArticleRejectsUnknownFields(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantErrors []FieldError
+	}{
+		{"known fields", `{"title":"t","content":"c","author":"a","tags":["go"]}`, http.StatusCreated, nil},
+		{"typo", `{"titel":"t","content":"c","author":"a"}`, http.StatusBadRequest, []FieldError{{Field: "titel", Message: "is not a known field"}}},
+		{"server assigned field", `{"title":"t","content":"c","author":"a","views":3}`, http.StatusBadRequest, []FieldError{{Field: "views", Message: "is not a known field"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodPost, "/articles", tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantErrors == nil {
+				return
+			}
+			if resp := decodeResponse(t, w, nil); !slices.Equal(resp.Errors, tt.wantErrors) {
+				t.Fatalf("errors = %+v, want %+v", resp.Errors, tt.wantErrors)
+			}
+
+			// A batch rejects just the item with the unknown key
+			w = performRequest(r, http.MethodPost, "/articles/batch", `[{"title":"t","content":"c","author":"a"},`+tt.body+`]`, "X-API-Key", "admin-key")
+			var results []BatchResult
+			decodeResponse(t, w, &results)
+			if w.Code != http.StatusMultiStatus || len(results) != 2 || !results[0].Success || results[1].Success ||
+				!slices.Equal(results[1].Errors, tt.wantErrors) {
+				t.Fatalf("batch: status %d, results %+v", w.Code, results)
+			}
+			if list, _ := store.List(ArticleFilter{}); len(list) != len(seedArticles)+1 {
+				t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles)+1)
+			}
+		})
+	}
+}
+
+func TestCreateArticleDryRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		body       string
+		wantStatus int
+		wantStored bool
+	}{
+		{"valid", "?dry_run=true", `{"id":7,"title":"  Dry   run ","content":"c","author":"a"}`, http.StatusOK, false},
+		{"invalid", "?dry_run=true", `{"title":"t"}`, http.StatusBadRequest, false},
+		{"unknown field", "?dry_run=true", `{"title":"t","content":"c","author":"a","titel":"t"}`, http.StatusBadRequest, false},
+		{"dry run off", "?dry_run=false", `{"title":"Dry run","content":"c","author":"a"}`, http.StatusCreated, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodPost, "/articles"+tt.query, tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var article Article
+			resp := decodeResponse(t, w, &article)
+			if tt.wantStatus == http.StatusOK {
+				// The would-be article is normalized but has no ID
+				if !resp.Success || article.ID != 0 || article.Title != "Dry run" {
+					t.Fatalf("unexpected response %+v, article %+v", resp, article)
+				}
+			}
+			if tt.wantStatus == http.StatusBadRequest && len(resp.Errors) == 0 {
+				t.Fatalf("no field errors in %+v", resp)
+			}
+
+			list, _ := store.List(ArticleFilter{IncludeDeleted: true})
+			if stored := len(list) > len(seedArticles); stored != tt.wantStored {
+				t.Fatalf("%d articles stored, want stored %v", len(list), tt.wantStored)
+			}
+			// Dry runs don't use up IDs either
+			created, err := store.Create(Article{Title: "t", Content: "c", Author: "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := len(list) + 1; created[0].ID != want {
+				t.Fatalf("next ID = %d, want %d", created[0].ID, want)
+			}
+		})
+	}
+}
+
+func TestDeleteArticles(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         string
+		body        string
+		wantStatus  int
+		wantResults []BulkDeleteResult
+		wantLive    []int
+	}{
+		{"existing and missing", "admin-key", `{"ids":[1,99]}`, http.StatusMultiStatus, []BulkDeleteResult{
+			{ID: 1, Deleted: true},
+			{ID: 99, Error: ErrArticleNotFound.Error()},
+		}, []int{2}},
+		{"all existing", "admin-key", `{"ids":[2,1]}`, http.StatusOK, []BulkDeleteResult{
+			{ID: 2, Deleted: true},
+			{ID: 1, Deleted: true},
+		}, nil},
+		{"repeated id", "admin-key", `{"ids":[2,2]}`, http.StatusOK, []BulkDeleteResult{
+			{ID: 2, Deleted: true},
+			{ID: 2, Deleted: true},
+		}, []int{1}},
+		{"no ids", "admin-key", `{"ids":[]}`, http.StatusBadRequest, nil, []int{1, 2}},
+		{"unknown field", "admin-key", `{"id":[1]}`, http.StatusBadRequest, nil, []int{1, 2}},
+		{"not an admin", "user-key-456", `{"ids":[1]}`, http.StatusForbidden, nil, []int{1, 2}},
+		{"no key", "", `{"ids":[1]}`, http.StatusUnauthorized, nil, []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, http.MethodDelete, "/articles", tt.body, "X-API-Key", tt.key)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantResults != nil {
+				var results []BulkDeleteResult
+				resp := decodeResponse(t, w, &results)
+				if !slices.Equal(results, tt.wantResults) || resp.Success != (tt.wantStatus == http.StatusOK) {
+					t.Fatalf("success %v, results %+v; want %+v", resp.Success, results, tt.wantResults)
+				}
+			}
+
+			// Deleted articles are only soft-deleted
+			list, _ := store.List(ArticleFilter{})
+			live := make([]int, len(list))
+			for i, a := range list {
+				live[i] = a.ID
+			}
+			slices.Sort(live)
+			if !slices.Equal(live, tt.wantLive) {
+				t.Fatalf("live articles %v, want %v", live, tt.wantLive)
+			}
+			if all, _ := store.List(ArticleFilter{IncludeDeleted: true}); len(all) != len(seedArticles) {
+				t.Fatalf("store has %d articles, want %d", len(all), len(seedArticles))
+			}
+		})
+	}
+}
+
+func TestGetArticlesLastModified(t *testing.T) {
+	store := newTestStore()
+	r := newTestRouter(store)
+
+	w := performRequest(r, http.MethodGet, "/articles", "")
+	lastModified := w.Header().Get("Last-Modified")
+	if w.Code != http.StatusOK || lastModified == "" {
+		t.Fatalf("status %d, Last-Modified %q", w.Code, lastModified)
+	}
+	since, err := http.ParseTime(lastModified)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name            string
+		ifModifiedSince string
+		wantStatus      int
+	}{
+		{"unchanged", lastModified, http.StatusNotModified},
+		{"later date", since.Add(time.Hour).Format(http.TimeFormat), http.StatusNotModified},
+		{"earlier date", since.Add(-time.Second).Format(http.TimeFormat), http.StatusOK},
+		{"not a date", "yesterday", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := performRequest(r, http.MethodGet, "/articles", "", "If-Modified-Since", tt.ifModifiedSince)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := w.Header().Get("Last-Modified"); got != lastModified {
+				t.Fatalf("Last-Modified = %q, want %q", got, lastModified)
+			}
+			if tt.wantStatus == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Fatalf("304 has a body: %q", w.Body)
+			}
+		})
+	}
+}
+
+func TestMemoryArticleStoreLastModified(t *testing.T) {
+	store := newTestStore()
+	tests := []struct {
+		name   string
+		mutate func() error
+	}{
+		{"create", func() error { _, err := store.Create(Article{Title: "t", Content: "c", Author: "a"}); return err }},
+		{"update", func() error {
+			_, err := store.Update(1, func(a *Article) error { a.Title = "Edited"; return nil })
+			return err
+		}},
+		{"delete", func() error { _, err := store.Delete(1); return err }},
+		{"restore", func() error { _, err := store.Restore(1); return err }},
+		{"delete many", func() error { _, err := store.DeleteMany([]int{1, 2}); return err }},
+	}
+	for _, tt := range tests {
+		before, _ := store.LastModified()
+		time.Sleep(time.Millisecond)
+		if err := tt.mutate(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if after, _ := store.LastModified(); !after.After(before) {
+			t.Fatalf("%s: last modified %v, want after %v", tt.name, after, before)
+		}
+	}
+
+	// Failed changes leave it alone
+	before, _ := store.LastModified()
+	if _, err := store.Delete(99); !errors.Is(err, ErrArticleNotFound) {
+		t.Fatalf("Delete(99): %v", err)
+	}
+	if after, _ := store.LastModified(); !after.Equal(before) {
+		t.Fatalf("last modified moved to %v after a failed delete", after)
+	}
+}
+
+func TestNotModifiedSince(t *testing.T) {
+	lastModified := time.Date(2024, 5, 1, 12, 0, 0, 500_000_000, time.UTC)
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"no header", "", false},
+		{"same second", "Wed, 01 May 2024 12:00:00 GMT", true},
+		{"later", "Wed, 01 May 2024 13:00:00 GMT", true},
+		{"earlier", "Wed, 01 May 2024 11:59:59 GMT", false},
+		{"malformed", "May 1st", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := notModifiedSince(tt.header, lastModified); got != tt.want {
+				t.Fatalf("notModifiedSince(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestArticleNormalize(t *testing.T) {
+	tests := []struct {
+		name string
+		in   Article
+		want Article
+	}{
+		{"clean", Article{Title: "Go", Content: "c", Author: "Ann"}, Article{Title: "Go", Content: "c", Author: "Ann"}},
+		{"padded", Article{Title: "  Go \t", Content: "\n c \n", Author: " Ann "}, Article{Title: "Go", Content: "c", Author: "Ann"}},
+		{"runs inside the title", Article{Title: "Getting   started\twith  Go"}, Article{Title: "Getting started with Go"}},
+		// Only the title is collapsed, content keeps its layout
+		{"content keeps inner spaces", Article{Content: " a  b\n\nc "}, Article{Content: "a  b\n\nc"}},
+		{"tags", Article{Tags: []string{" go ", "web"}}, Article{Tags: []string{"go", "web"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.in.Normalize()
+			if tt.in.Title != tt.want.Title || tt.in.Content != tt.want.Content || tt.in.Author != tt.want.Author ||
+				!slices.Equal(tt.in.Tags, tt.want.Tags) {
+				t.Fatalf("normalized to %+v, want %+v", tt.in, tt.want)
+			}
+		})
+	}
+}
+
+func TestArticleInputIsNormalized(t *testing.T) {
+	padded := `{"title":"  Padded   title ","content":"\tbody \n","author":" Ann ","tags":[" go "]}`
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		id     int
+	}{
+		{"create", http.MethodPost, "/articles", padded, 3},
+		{"batch", http.MethodPost, "/articles/batch", "[" + padded + "]", 3},
+		{"update", http.MethodPut, "/articles/1", strings.Replace(padded, "{", `{"version":1,`, 1), 1},
+		{"patch", http.MethodPatch, "/articles/1", padded, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, tt.method, tt.path, tt.body, "X-API-Key", "admin-key")
+			if w.Code >= 300 {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			got, err := store.Get(tt.id, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Title != "Padded title" || got.Content != "body" || got.Author != "Ann" || !slices.Equal(got.Tags, []string{"go"}) {
+				t.Fatalf("stored %+v", got)
+			}
+		})
+	}
+}
+
+func TestMiddlewareLogSink(t *testing.T) {
+	// Nothing may reach the standard logger any more
+	var global bytes.Buffer
+	log.SetOutput(&global)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	var sink bytes.Buffer
+	r := gin.New()
+	r.Use(ErrorHandlerMiddleware(&sink), RequestIDMiddleware(newHandlerLogger(&sink, false)), LoggingMiddleware(&sink, false))
+	r.GET("/ping", ping)
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+
+	performRequest(r, http.MethodGet, "/ping", "", "X-Request-ID", "req-ping")
+	performRequest(r, http.MethodGet, "/panic", "", "X-Request-ID", "req-panic")
+
+	logs := sink.String()
+	for _, want := range []string{"[req-ping] GET /ping 200", "[req-panic] panic recovered on GET /panic: boom"} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log is missing %q:\n%s", want, logs)
+		}
+	}
+	if global.Len() != 0 {
+		t.Fatalf("standard logger got %q", global.String())
+	}
+}
+
+// Named so the logged stack trace can be checked for it
+func panickingHandler(c *gin.Context) {
+	panic(errors.New("boom: secret detail"))
+}
+
+func TestErrorHandlerLogsPanics(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout bool
+	}{
+		{"in the handler", false},
+		// The handler runs on another goroutine, whose stack is the useful one
+		{"behind the timeout middleware", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			r := gin.New()
+			r.Use(ErrorHandlerMiddleware(&logs), RequestIDMiddleware(slog.New(slog.DiscardHandler)))
+			if tt.timeout {
+				r.Use(TimeoutMiddleware(time.Second))
+			}
+			r.POST("/articles/:id", panickingHandler)
+
+			w := performRequest(r, http.MethodPost, "/articles/7", "", "X-Request-ID", "req-panic")
+			if w.Code != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusInternalServerError)
+			}
+			// The client gets a generic error without any of the panic
+			resp := decodeResponse(t, w, nil)
+			if resp.Success || resp.Error == "" || resp.RequestID != "req-panic" {
+				t.Fatalf("unexpected response %+v", resp)
+			}
+			for _, leak := range []string{"boom", "goroutine", ".go:"} {
+				if strings.Contains(w.Body.String(), leak) {
+					t.Fatalf("response leaks %q: %s", leak, w.Body)
+				}
+			}
+
+			logged := logs.String()
+			for _, want := range []string{"[req-panic] panic recovered on POST /articles/7: boom: secret detail", "goroutine ", "panickingHandler"} {
+				if !strings.Contains(logged, want) {
+					t.Errorf("log is missing %q:\n%s", want, logged)
+				}
+			}
+		})
+	}
+}
+
+func TestErrorHandlerRepanicsAbortHandler(t *testing.T) {
+	var logs bytes.Buffer
+	r := gin.New()
+	r.Use(ErrorHandlerMiddleware(&logs))
+	r.GET("/abort", func(c *gin.Context) { panic(http.ErrAbortHandler) })
+
+	// net/http aborts the response quietly, so the panic has to reach it
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Fatalf("recovered %v, want %v", p, http.ErrAbortHandler)
+		}
+		if logs.Len() != 0 {
+			t.Fatalf("abort was logged: %q", logs.String())
+		}
+	}()
+	performRequest(r, http.MethodGet, "/abort", "")
+}
+
+// Router like newTestRouter's that deduplicates article submissions within window
+func newDedupRouter(store ArticleStore, window time.Duration) *gin.Engine {
+	return newRouter(routerConfig{
+		store:       store,
+		keys:        NewMemoryKeyStore(defaultAPIKeys),
+		logOutput:   io.Discard,
+		rateLimits:  defaultRateLimitTiers,
+		dedupWindow: window,
+	})
+}
+
+func TestCreateArticleDedup(t *testing.T) {
+	original := `{"title":"Same","content":"c","author":"Ann"}`
+	tests := []struct {
+		name       string
+		window     time.Duration
+		body       string
+		wantStatus int
+		wantSameID bool
+	}{
+		{"identical", time.Minute, original, http.StatusOK, true},
+		{"identical once normalized", time.Minute, `{"title":" Same ","content":"c ","author":"Ann","tags":["x"]}`, http.StatusOK, true},
+		{"other title", time.Minute, `{"title":"Other","content":"c","author":"Ann"}`, http.StatusCreated, false},
+		{"other content", time.Minute, `{"title":"Same","content":"d","author":"Ann"}`, http.StatusCreated, false},
+		{"other author", time.Minute, `{"title":"Same","content":"c","author":"Bob"}`, http.StatusCreated, false},
+		{"dedup off", 0, original, http.StatusCreated, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newDedupRouter(newTestStore(), tt.window)
+			var first Article
+			decodeResponse(t, performRequest(r, http.MethodPost, "/articles", original, "X-API-Key", "admin-key"), &first)
+
+			w := performRequest(r, http.MethodPost, "/articles", tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var second Article
+			decodeResponse(t, w, &second)
+			if (second.ID == first.ID) != tt.wantSameID {
+				t.Fatalf("second article has id %d, first %d", second.ID, first.ID)
+			}
+			if want := "/articles/" + strconv.Itoa(second.ID); w.Header().Get("Location") != want {
+				t.Fatalf("Location = %q, want %q", w.Header().Get("Location"), want)
+			}
+		})
+	}
+}
+
+func TestCreateArticleDedupMisses(t *testing.T) {
+	body := `{"title":"Same","content":"c","author":"Ann"}`
+	tests := []struct {
+		name    string
+		between func(t *testing.T, store ArticleStore, id int)
+	}{
+		{"window passed", func(t *testing.T, store ArticleStore, id int) { time.Sleep(60 * time.Millisecond) }},
+		// A deleted article isn't handed back, a new one is created
+		{"first one deleted", func(t *testing.T, store ArticleStore, id int) {
+			if _, err := store.Delete(id); err != nil {
+				t.Fatal(err)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newDedupRouter(store, 50*time.Millisecond)
+			var first Article
+			decodeResponse(t, performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", "admin-key"), &first)
+
+			tt.between(t, store, first.ID)
+			w := performRequest(r, http.MethodPost, "/articles", body, "X-API-Key", "admin-key")
+			var second Article
+			decodeResponse(t, w, &second)
+			if w.Code != http.StatusCreated || second.ID == first.ID {
+				t.Fatalf("status %d, id %d after first id %d", w.Code, second.ID, first.ID)
+			}
+		})
+	}
+}
+
+func TestCreateArticleDedupConcurrent(t *testing.T) {
+	store := newTestStore()
+	r := newDedupRouter(store, time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			performRequest(r, http.MethodPost, "/articles", `{"title":"Same","content":"c","author":"Ann"}`, "X-API-Key", "admin-key")
+		}()
+	}
+	wg.Wait()
+
+	if list, _ := store.List(ArticleFilter{}); len(list) != len(seedArticles)+1 {
+		t.Fatalf("store has %d articles, want %d", len(list), len(seedArticles)+1)
+	}
+}
+
+func TestDedupWindowFromEnv(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"0", 0, false},
+		{"30", 30 * time.Second, false},
+		{"-5", 0, true},
+		{"1m", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			t.Setenv("DEDUP_WINDOW_SECONDS", tt.value)
+			got, err := dedupWindowFromEnv()
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("dedupWindowFromEnv() = %v, %v; want %v, error %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestArticleTags(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		wantTags   []string
+	}{
+		{"create tagged", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a","tags":["go","web"]}`, http.StatusCreated, []string{"go", "web"}},
+		{"create untagged", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a"}`, http.StatusCreated, nil},
+		{"empty tag", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a","tags":["go"," "]}`, http.StatusBadRequest, nil},
+		{"tag too long", http.MethodPost, "/articles", `{"title":"t","content":"c","author":"a","tags":["` + strings.Repeat("x", maxTagLength+1) + `"]}`, http.StatusBadRequest, nil},
+		{"update replaces tags", http.MethodPut, "/articles/2", `{"title":"t","content":"c","author":"a","tags":["web"],"version":1}`, http.StatusOK, []string{"web"}},
+		{"patch replaces tags", http.MethodPatch, "/articles/2", `{"tags":["web"]}`, http.StatusOK, []string{"web"}},
+		{"patch clears tags", http.MethodPatch, "/articles/2", `{"tags":[]}`, http.StatusOK, []string{}},
+		{"patch keeps tags", http.MethodPatch, "/articles/2", `{"title":"t"}`, http.StatusOK, []string{"go", "gin"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := newTestStore()
+			r := newTestRouter(store)
+
+			w := performRequest(r, tt.method, tt.path, tt.body, "X-API-Key", "admin-key")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusBadRequest {
+				return
+			}
+			var article Article
+			decodeResponse(t, w, &article)
+			stored, err := store.Get(article.ID, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(article.Tags, tt.wantTags) || !slices.Equal(stored.Tags, tt.wantTags) {
+				t.Fatalf("tags %q, stored %q; want %q", article.Tags, stored.Tags, tt.wantTags)
+			}
+		})
+	}
+}
+
+func TestGetArticlesByTag(t *testing.T) {
+	tests := []struct {
+		name    string
+		query   string
+		wantIDs []int
+	}{
+		{"shared tag", "tag=go", []int{1, 2}},
+		{"one article", "tag=gin", []int{2}},
+		{"exact match", "tag=GO", nil},
+		{"no such tag", "tag=rust", nil},
+		{"with another filter", "tag=go&author=john+doe", []int{1}},
+		{"no tag filter", "tag=", []int{1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			w := performRequest(r, http.MethodGet, "/articles?"+tt.query, "")
+			var list []Article
+			decodeResponse(t, w, &list)
+			ids := make([]int, 0, len(list))
+			for _, a := range list {
+				ids = append(ids, a.ID)
+			}
+			slices.Sort(ids)
+			if w.Code != http.StatusOK || !slices.Equal(ids, tt.wantIDs) {
+				t.Fatalf("status %d, ids %v; want %v", w.Code, ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestMemoryArticleStoreCopiesTags(t *testing.T) {
+	store := newTestStore()
+	tags := []string{"go"}
+	created, err := store.Create(Article{Title: "t", Content: "c", Author: "a", Tags: tags})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The caller's slice isn't shared with the store
+	tags[0] = "changed"
+	if got, _ := store.Get(created[0].ID, false); !slices.Equal(got.Tags, []string{"go"}) {
+		t.Fatalf("stored tags %q, want [go]", got.Tags)
+	}
+
+	// Neither is the one a failed update changed in place
+	fail := errors.New("rejected")
+	if _, err := store.Update(created[0].ID, func(a *Article) error { a.Tags[0] = "changed"; return fail }); !errors.Is(err, fail) {
+		t.Fatalf("Update: %v", err)
+	}
+	if got, _ := store.Get(created[0].ID, false); !slices.Equal(got.Tags, []string{"go"}) {
+		t.Fatalf("stored tags %q after a failed update, want [go]", got.Tags)
+	}
+}
+
+func TestFailedRequestsAreRateLimited(t *testing.T) {
+	burst := defaultRateLimitTiers[anonymousRole].Burst
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		key        string
+		wantStatus int
+	}{
+		{"bad api key", http.MethodPost, "/articles", "guessed-key", http.StatusUnauthorized},
+		{"unknown route", http.MethodGet, "/nope", "", http.StatusNotFound},
+		{"wrong method", http.MethodPut, "/ping", "", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRouter(newTestStore())
+
+			for i := 0; i < burst; i++ {
+				if w := performRequest(r, tt.method, tt.path, `{}`, "X-API-Key", tt.key); w.Code != tt.wantStatus {
+					t.Fatalf("request %d: status = %d, want %d", i, w.Code, tt.wantStatus)
+				}
+			}
+			w := performRequest(r, tt.method, tt.path, `{}`, "X-API-Key", tt.key)
+			if w.Code != http.StatusTooManyRequests {
+				t.Fatalf("status after %d failures = %d, want %d", burst, w.Code, http.StatusTooManyRequests)
+			}
+			if seconds, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || seconds < 1 {
+				t.Fatalf("Retry-After = %q, want a positive integer", w.Header().Get("Retry-After"))
+			}
+
+			// The IP is blocked whatever it sends, apart from the health checks
+			if w := performRequest(r, http.MethodGet, "/admin/stats", "", "X-API-Key", "admin-key"); w.Code != http.StatusTooManyRequests {
+				t.Fatalf("valid key after the failures: status = %d, want %d", w.Code, http.StatusTooManyRequests)
+			}
+			if w := performRequest(r, http.MethodGet, "/healthz", ""); w.Code != http.StatusOK {
+				t.Fatalf("/healthz: status = %d, want %d", w.Code, http.StatusOK)
+			}
+		})
+	}
+}
+
+func TestSuccessfulRequestsDontCountAsFailures(t *testing.T) {
+	r := newTestRouter(newTestStore())
+
+	// More requests than the anonymous burst, all within the admin tier
+	for i := 0; i < defaultRateLimitTiers[anonymousRole].Burst*2; i++ {
+		if w := performRequest(r, http.MethodGet, "/admin/stats", "", "X-API-Key", "admin-key"); w.Code != http.StatusOK {
+			t.Fatalf("request %d: status = %d, want %d", i, w.Code, http.StatusOK)
+		}
+	}
+	if w := performRequest(r, http.MethodPost, "/articles", `{}`, "X-API-Key", "guessed-key"); w.Code != http.StatusUnauthorized {
+		t.Fatalf("bad key: status = %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,455 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// OpenAPI 3 document describing the article API
+type OpenAPISpec struct {
+	OpenAPI    string                 `json:"openapi"`
+	Info       OpenAPIInfo            `json:"info"`
+	Paths      map[string]OpenAPIPath `json:"paths"`
+	Components OpenAPIComponents      `json:"components"`
+}
+
+type OpenAPIInfo struct {
+	Title   string `json:"title"`
+	Version string `json:"version"`
+}
+
+// Operations of a path keyed by lower case HTTP method
+type OpenAPIPath map[string]OpenAPIOperation
+
+type OpenAPIOperation struct {
+	Summary     string                     `json:"summary"`
+	Parameters  []OpenAPIParameter         `json:"parameters,omitempty"`
+	RequestBody *OpenAPIRequestBody        `json:"requestBody,omitempty"`
+	Responses   map[string]OpenAPIResponse `json:"responses"`
+	Security    []map[string][]string      `json:"security,omitempty"`
+}
+
+type OpenAPIParameter struct {
+	Name        string        `json:"name"`
+	In          string        `json:"in"`
+	Description string        `json:"description,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Schema      OpenAPISchema `json:"schema"`
+}
+
+type OpenAPIRequestBody struct {
+	Required bool                    `json:"required"`
+	Content  map[string]OpenAPIMedia `json:"content"`
+}
+
+type OpenAPIResponse struct {
+	Description string                  `json:"description"`
+	Content     map[string]OpenAPIMedia `json:"content,omitempty"`
+}
+
+type OpenAPIMedia struct {
+	Schema OpenAPISchema `json:"schema"`
+}
+
+type OpenAPISchema struct {
+	Ref         string                   `json:"$ref,omitempty"`
+	Type        string                   `json:"type,omitempty"`
+	Format      string                   `json:"format,omitempty"`
+	Description string                   `json:"description,omitempty"`
+	MinLength   int                      `json:"minLength,omitempty"`
+	MaxLength   int                      `json:"maxLength,omitempty"`
+	MaxItems    int                      `json:"maxItems,omitempty"`
+	Enum        []string                 `json:"enum,omitempty"`
+	Items       *OpenAPISchema           `json:"items,omitempty"`
+	Properties  map[string]OpenAPISchema `json:"properties,omitempty"`
+	Required    []string                 `json:"required,omitempty"`
+}
+
+type OpenAPIComponents struct {
+	Schemas         map[string]OpenAPISchema         `json:"schemas"`
+	SecuritySchemes map[string]OpenAPISecurityScheme `json:"securitySchemes"`
+}
+
+type OpenAPISecurityScheme struct {
+	Type         string `json:"type"`
+	In           string `json:"in,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// Shorthands for building the spec below
+func schemaRef(name string) OpenAPISchema {
+	return OpenAPISchema{Ref: "#/components/schemas/" + name}
+}
+
+func jsonContent(schema OpenAPISchema) map[string]OpenAPIMedia {
+	return map[string]OpenAPIMedia{"application/json": {Schema: schema}}
+}
+
+func envelope(description string) OpenAPIResponse {
+	return OpenAPIResponse{Description: description, Content: jsonContent(schemaRef("Response"))}
+}
+
+func queryParam(name, typ, description string) OpenAPIParameter {
+	return OpenAPIParameter{Name: name, In: "query", Description: description, Schema: OpenAPISchema{Type: typ}}
+}
+
+var (
+	idParam = OpenAPIParameter{
+		Name:     "id",
+		In:       "path",
+		Required: true,
+		Schema:   OpenAPISchema{Type: "integer"},
+	}
+	articleBody = &OpenAPIRequestBody{
+		Required: true,
+		Content:  jsonContent(schemaRef("ArticleInput")),
+	}
+	// Either scheme is accepted; Bearer tokens only when the server has a JWT_SECRET
+	protectedAuth = []map[string][]string{{"ApiKeyAuth": {}}, {"BearerAuth": {}}}
+)
+
+// Builds the OpenAPI document for the routes registered in main
+func buildOpenAPISpec() OpenAPISpec {
+	return OpenAPISpec{
+		OpenAPI: "3.0.3",
+		Info:    OpenAPIInfo{Title: "Articles API", Version: "1.0.0"},
+		Paths: map[string]OpenAPIPath{
+			"/articles": {
+				"get": {
+					Summary: "List articles",
+					Parameters: []OpenAPIParameter{
+						queryParam("page", "integer", "Page number, starting at 1"),
+						queryParam("limit", "integer", "Page size, at most 100"),
+						queryParam("author", "string", "Only articles by this author"),
+						queryParam("q", "string", "Case-insensitive search in title and content"),
+						{
+							Name:   "sort",
+							In:     "query",
+							Schema: OpenAPISchema{Type: "string", Enum: []string{"created_at", "-created_at", "title", "-title"}},
+						},
+						{
+							Name:   "category",
+							In:     "query",
+							Schema: OpenAPISchema{Type: "string", Enum: articleCategories},
+						},
+						queryParam("tag", "string", "Only articles with this tag"),
+						queryParam("include_deleted", "boolean", "Include soft-deleted articles, admin only"),
+						queryParam("fields", "string", "Comma separated article fields to return, e.g. id,title"),
+					},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("A page of articles"),
+						"304": {Description: "No article changed since If-Modified-Since"},
+						"400": envelope("Invalid query parameters"),
+					},
+				},
+				"post": {
+					Summary: "Create an article",
+					Parameters: []OpenAPIParameter{
+						{
+							Name:        "Idempotency-Key",
+							In:          "header",
+							Description: "Retries with the same key return the originally created article",
+							Schema:      OpenAPISchema{Type: "string"},
+						},
+						queryParam("dry_run", "boolean", "Only validate the article, nothing is created"),
+					},
+					RequestBody: articleBody,
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Dry run passed, or an identical article was created recently"),
+						"201": envelope("The created article"),
+						"400": envelope("Invalid article"),
+						"401": envelope("Missing or invalid API key"),
+						"507": envelope("The article store is full"),
+					},
+					Security: protectedAuth,
+				},
+				"delete": {
+					Summary: "Soft-delete several articles",
+					RequestBody: &OpenAPIRequestBody{
+						Required: true,
+						Content: jsonContent(OpenAPISchema{
+							Type:       "object",
+							Properties: map[string]OpenAPISchema{"ids": {Type: "array", Items: &OpenAPISchema{Type: "integer"}}},
+							Required:   []string{"ids"},
+						}),
+					},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Every article was deleted"),
+						"207": envelope("Some ids did not match an article"),
+						"400": envelope("No ids were given"),
+						"403": envelope("Admin role required"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/articles/batch": {
+				"post": {
+					Summary: "Create several articles at once",
+					RequestBody: &OpenAPIRequestBody{
+						Required: true,
+						Content:  jsonContent(OpenAPISchema{Type: "array", Items: &OpenAPISchema{Ref: "#/components/schemas/ArticleInput"}}),
+					},
+					Responses: map[string]OpenAPIResponse{
+						"201": envelope("Every article was created"),
+						"207": envelope("Some articles were rejected"),
+						"400": envelope("Body is not an array"),
+						"507": envelope("The article store is full"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/articles/{id}": {
+				"get": {
+					Summary:    "Get an article",
+					Parameters: []OpenAPIParameter{idParam},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("The article"),
+						"304": {Description: "The article matches If-None-Match"},
+						"404": envelope("Article not found"),
+					},
+				},
+				"head": {
+					Summary:    "Check that an article exists",
+					Parameters: []OpenAPIParameter{idParam},
+					Responses: map[string]OpenAPIResponse{
+						"200": {Description: "The article exists"},
+						"304": {Description: "The article matches If-None-Match"},
+						"404": {Description: "Article not found"},
+					},
+				},
+				"put": {
+					Summary: "Replace an article",
+					Parameters: []OpenAPIParameter{idParam, {
+						Name:        "If-Match",
+						In:          "header",
+						Description: "Expected article version; may be sent as the version body field instead",
+						Schema:      OpenAPISchema{Type: "string"},
+					}},
+					RequestBody: articleBody,
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("The updated article"),
+						"400": envelope("Invalid article"),
+						"404": envelope("Article not found"),
+						"409": envelope("The article version has changed"),
+						"428": envelope("No expected version was sent"),
+					},
+					Security: protectedAuth,
+				},
+				"patch": {
+					Summary:    "Update some fields of an article",
+					Parameters: []OpenAPIParameter{idParam},
+					RequestBody: &OpenAPIRequestBody{
+						Required: true,
+						Content:  jsonContent(schemaRef("ArticlePatch")),
+					},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("The updated article"),
+						"400": envelope("Invalid field values"),
+						"404": envelope("Article not found"),
+					},
+					Security: protectedAuth,
+				},
+				"delete": {
+					Summary:    "Soft-delete an article",
+					Parameters: []OpenAPIParameter{idParam},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Article deleted"),
+						"404": envelope("Article not found"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/articles/stream": {
+				"get": {
+					Summary: "Server-Sent Events stream of article changes",
+					Responses: map[string]OpenAPIResponse{
+						"200": {Description: "Event stream", Content: map[string]OpenAPIMedia{
+							"text/event-stream": {Schema: schemaRef("ArticleEvent")},
+						}},
+					},
+				},
+			},
+			"/ws/articles": {
+				"get": {
+					Summary: "WebSocket stream of article changes, one ArticleEvent per message",
+					Responses: map[string]OpenAPIResponse{
+						"101": {Description: "Switching to the WebSocket protocol"},
+						"400": {Description: "Not a WebSocket upgrade request"},
+					},
+				},
+			},
+			"/ping": {
+				"get": {
+					Summary: "Check that the API answers",
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("pong"),
+					},
+				},
+			},
+			"/healthz": {
+				"get": {
+					Summary: "Health check, never rate limited or authenticated",
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Status and start time of the server"),
+					},
+				},
+			},
+			"/version": {
+				"get": {
+					Summary: "Build information",
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Version, git commit and build time"),
+					},
+				},
+			},
+			"/admin/stats": {
+				"get": {
+					Summary: "Article and request counts",
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Server statistics"),
+						"403": envelope("Admin role required"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/admin/keys": {
+				"post": {
+					Summary: "Add an API key",
+					RequestBody: &OpenAPIRequestBody{
+						Required: true,
+						Content:  jsonContent(schemaRef("APIKeyInput")),
+					},
+					Responses: map[string]OpenAPIResponse{
+						"201": envelope("The added key and its role"),
+						"400": envelope("Invalid role"),
+						"403": envelope("Admin role required"),
+						"409": envelope("The key already exists"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/admin/keys/{key}": {
+				"delete": {
+					Summary: "Revoke an API key",
+					Parameters: []OpenAPIParameter{{
+						Name:     "key",
+						In:       "path",
+						Required: true,
+						Schema:   OpenAPISchema{Type: "string"},
+					}},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("Key revoked"),
+						"403": envelope("Admin role required"),
+						"404": envelope("Key not found"),
+						"409": envelope("The key is the last admin key"),
+					},
+					Security: protectedAuth,
+				},
+			},
+			"/admin/articles/{id}/restore": {
+				"post": {
+					Summary:    "Restore a soft-deleted article",
+					Parameters: []OpenAPIParameter{idParam},
+					Responses: map[string]OpenAPIResponse{
+						"200": envelope("The restored article"),
+						"400": envelope("Article is not deleted"),
+						"403": envelope("Admin role required"),
+						"404": envelope("Article not found"),
+					},
+					Security: protectedAuth,
+				},
+			},
+		},
+		Components: OpenAPIComponents{
+			Schemas: map[string]OpenAPISchema{
+				"Article": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"id":         {Type: "integer"},
+						"title":      {Type: "string"},
+						"content":    {Type: "string"},
+						"author":     {Type: "string"},
+						"category":   {Type: "string", Enum: articleCategories},
+						"tags":       {Type: "array", Items: &OpenAPISchema{Type: "string"}},
+						"created_at": {Type: "string", Format: "date-time"},
+						"updated_at": {Type: "string", Format: "date-time"},
+						"deleted":    {Type: "boolean"},
+						"deleted_at": {Type: "string", Format: "date-time"},
+						"version":    {Type: "integer"},
+					},
+				},
+				"ArticleInput": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"title":    {Type: "string", MaxLength: maxTitleLength},
+						"content":  {Type: "string", MaxLength: maxContentLength},
+						"author":   {Type: "string", MaxLength: maxAuthorLength},
+						"category": {Type: "string", Enum: articleCategories},
+						"tags":     {Type: "array", MaxItems: maxTags, Items: &OpenAPISchema{Type: "string", MinLength: 1, MaxLength: maxTagLength}},
+						"version":  {Type: "integer"},
+					},
+					Required: []string{"title", "content", "author"},
+				},
+				// Every field is optional, only the ones sent are changed
+				"ArticlePatch": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"title":    {Type: "string", MaxLength: maxTitleLength},
+						"content":  {Type: "string", MaxLength: maxContentLength},
+						"author":   {Type: "string", MaxLength: maxAuthorLength},
+						"category": {Type: "string", Enum: articleCategories},
+						"tags":     {Type: "array", MaxItems: maxTags, Items: &OpenAPISchema{Type: "string", MinLength: 1, MaxLength: maxTagLength}},
+					},
+				},
+				"APIKeyInput": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"key":  {Type: "string", Description: "Generated when left out"},
+						"role": {Type: "string", Enum: []string{"admin", "user"}},
+					},
+					Required: []string{"role"},
+				},
+				"ArticleEvent": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"type":    {Type: "string", Enum: []string{"created", "updated", "deleted", "restored"}},
+						"article": schemaRef("Article"),
+					},
+				},
+				"Response": {
+					Type: "object",
+					Properties: map[string]OpenAPISchema{
+						"success":    {Type: "boolean"},
+						"data":       {},
+						"message":    {Type: "string"},
+						"error":      {Type: "string"},
+						"request_id": {Type: "string"},
+						"meta":       {Type: "object"},
+						"errors": {Type: "array", Items: &OpenAPISchema{
+							Type: "object",
+							Properties: map[string]OpenAPISchema{
+								"field":   {Type: "string"},
+								"message": {Type: "string"},
+							},
+						}},
+					},
+					Required: []string{"success"},
+				},
+			},
+			SecuritySchemes: map[string]OpenAPISecurityScheme{
+				"ApiKeyAuth": {Type: "apiKey", In: "header", Name: "X-API-Key"},
+				"BearerAuth": {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+	}
+}
+
+// The spec never changes at runtime, so it is built once
+var openAPISpec = buildOpenAPISpec()
+
+func getOpenAPISpec(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPISpec)
+}
@@ -2,19 +2,72 @@
 package main
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"net/http"
+	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 // This struct defines a user in the system
 type User struct {
-	ID    int    `json:"int"`
-	Name  string `json:"name"`
-	Email string `json:"email"`
-	Age   int    `json:"age"`
+	ID        UserID    `json:"id"`
+	Name      string    `json:"name"`
+	Email     string    `json:"email"`
+	Age       int       `json:"age"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Bumped on every change, a full update has to send the version it was based on
+	Version int `json:"version"`
+}
+
+// Identifies a user, either a sequential integer or a UUID depending on the USER_IDS setting.
+// Integer ids are written to JSON as numbers, like they always were, and UUIDs as strings.
+type UserID string
+
+func (id UserID) MarshalJSON() ([]byte, error) {
+	// Atoi also accepts ids like "+5" and "007", which aren't valid JSON numbers
+	if n, err := strconv.Atoi(string(id)); err == nil && strconv.Itoa(n) == string(id) {
+		return []byte(id), nil
+	}
+	return json.Marshal(string(id))
+}
+
+func (id *UserID) UnmarshalJSON(data []byte) error {
+	var n json.Number
+	if err := json.Unmarshal(data, &n); err == nil {
+		if _, err := n.Int64(); err != nil {
+			return errors.New("user id must be an integer or a string")
+		}
+		*id = UserID(n.String())
+		return nil
+	}
+	var str string
+	if err := json.Unmarshal(data, &str); err != nil {
+		return errors.New("user id must be an integer or a string")
+	}
+	*id = UserID(str)
+	return nil
+}
+
+// This struct holds the fields of a partial user update, nil means the field was not sent
+type UserPatch struct {
+	Name  *string `json:"name"`
+	Email *string `json:"email"`
+	Age   *int    `json:"age"`
 }
 
 // This struct represents a standard API response
@@ -24,43 +77,175 @@ type Response struct {
 	Message string      `json:"message,omitempty"`
 	Error   string      `json:"error,omitempty"`
 	Code    int         `json:"code,omitempty"`
+	Meta    interface{} `json:"meta,omitempty"`
+}
+
+// This struct holds the outcome of one user in a batch import
+type BatchResult struct {
+	Index   int    `json:"index"`
+	Success bool   `json:"success"`
+	Data    *User  `json:"data,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// This struct holds the age statistics of the users, all zero when there are no users
+type UserStats struct {
+	Count     int     `json:"count"`
+	MinAge    int     `json:"min_age"`
+	MaxAge    int     `json:"max_age"`
+	MeanAge   float64 `json:"mean_age"`
+	MedianAge float64 `json:"median_age"`
+}
+
+// This struct describes which page of a list was returned
+type PageMeta struct {
+	Total      int `json:"total"`
+	Page       int `json:"page"`
+	TotalPages int `json:"total_pages"`
+	Limit      int `json:"limit"`
 }
 
 // List of users
 var users = []User{
-	{1, "John Doe", "john.doe@gmail.com", 30},
-	{2, "Jane Smith", "jane.smith@gmail.com", 30},
-	{3, "Max Williams", "max.williams@gmail.com", 30},
+	{"1", "John Doe", "john.doe@gmail.com", 30, time.Now(), time.Now(), 1},
+	{"2", "Jane Smith", "jane.smith@gmail.com", 30, time.Now(), time.Now(), 1},
+	{"3", "Max Williams", "max.williams@gmail.com", 30, time.Now(), time.Now(), 1},
 }
 
+// The integer id the next user gets, unless new users get UUIDs
 var nextId int = 4
 
+// Whether new users get UUIDs instead of sequential integer ids, set with USER_IDS=uuid
+var useUUIDs bool
+
+const (
+	jsonPatchContentType = "application/json-patch+json"
+
+	defaultUserLimit = 20
+	maxUserLimit     = 100
+	maxUserAge       = 150
+)
+
+// Orderings accepted by the sort query parameter, a leading "-" means descending
+var userSorts = map[string]func(a, b User) bool{
+	"name":  func(a, b User) bool { return a.Name < b.Name },
+	"-name": func(a, b User) bool { return a.Name > b.Name },
+	"age":   func(a, b User) bool { return a.Age < b.Age },
+	"-age":  func(a, b User) bool { return a.Age > b.Age },
+}
+
+// Guards users and nextId against concurrent requests, handlers that only read take the read lock
+var usersMux sync.RWMutex
+
+// Path of the JSON file the users are persisted to
+var usersFile string
+
 func main() {
+	// Loading the users saved by a previous run
+	usersFile = os.Getenv("USERS_FILE")
+	if usersFile == "" {
+		usersFile = "users.json"
+	}
+	// Integer ids stay the default for the learning example, UUIDs don't give away how many users exist
+	switch strategy := os.Getenv("USER_IDS"); strategy {
+	case "", "int":
+	case "uuid":
+		useUUIDs = true
+	default:
+		log.Fatalf("Invalid USER_IDS %q: must be int or uuid", strategy)
+	}
+	if err := loadUsers(usersFile); err != nil {
+		log.Fatalf("Failed to load users: %v", err)
+	}
+
+	router := setupRouter()
+	router.Run(":8080")
+}
+
+// Helper function building the router with all the user routes
+func setupRouter() *gin.Engine {
 	// Utilsing default router provided by Go
 	router := gin.Default()
 	// Defining the routes
 	router.GET("/users", getAllUsers)
+	router.GET("/users/search", searchUser)
+	router.GET("/users/export", exportUsers)
+	router.GET("/users/stats", getUserStats)
 	router.GET("/users/:id", getUserById)
 	router.POST("/users", createUser)
+	router.POST("/users/batch", createUsersBatch)
 	router.PUT("/users/:id", updateUser)
+	router.PATCH("/users/:id", patchUser)
 	router.DELETE("/users/:id", deleteUser)
-	// router.GET("/users/:id", searchUser)
-
-	router.Run(":8080")
+	return router
 }
 
 // Handler for retrieving all the users
 func getAllUsers(c *gin.Context) {
+	page, limit, err := parsePagination(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	filter, err := parseUserFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	sortKey := c.Query("sort")
+	less, ok := userSorts[sortKey]
+	if sortKey != "" && !ok {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "sort must be one of name, -name, age, -age",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	usersMux.RLock()
+	matched := filterUsers(users, filter)
+	usersMux.RUnlock()
+
+	// matched is a copy, so sorting it keeps the stored order intact
+	if less != nil {
+		sort.SliceStable(matched, func(i, j int) bool {
+			return less(matched[i], matched[j])
+		})
+	}
+
+	total := len(matched)
+	// Pages past the end are not an error, they are just empty
+	start := min((page-1)*limit, total)
+	end := min(start+limit, total)
+	list := matched[start:end]
+
 	c.JSON(http.StatusOK, Response{
 		Success: true,
-		Data:    users,
+		Data:    list,
+		Meta: PageMeta{
+			Total:      total,
+			Page:       page,
+			TotalPages: (total + limit - 1) / limit,
+			Limit:      limit,
+		},
 	})
 }
 
 // Handler for retrieving specific user by Id
 func getUserById(c *gin.Context) {
 	// Used to retrieve the id parameter from the URL
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := parseUserID(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -69,7 +254,14 @@ func getUserById(c *gin.Context) {
 		})
 		return
 	}
-	user, _ := findUserById(id)
+	// Copying the user while the lock is held, the pointer is into the shared slice
+	usersMux.RLock()
+	var user *User
+	if found, _ := findUserById(id); found != nil {
+		copied := *found
+		user = &copied
+	}
+	usersMux.RUnlock()
 	if user == nil {
 		c.JSON(http.StatusNotFound, Response{
 			Success: false,
@@ -87,11 +279,15 @@ func getUserById(c *gin.Context) {
 
 func createUser(c *gin.Context) {
 	var newUser User
-	// Checking whether JSON binding is implemented
-	if err := c.ShouldBindBodyWithJSON(&newUser); err != nil {
+	// Checking whether JSON binding is implemented, unknown keys are rejected so typos don't go unnoticed
+	if err := bindStrictJSON(c, &newUser); err != nil {
+		message := "invalid JSON body"
+		if field, ok := unknownField(err); ok {
+			message = "unknown field " + strconv.Quote(field)
+		}
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
-			Error:   "invalid JSON body",
+			Error:   message,
 			Code:    http.StatusBadRequest,
 		})
 		return
@@ -106,11 +302,26 @@ func createUser(c *gin.Context) {
 		})
 		return
 	}
-	// Passing the nextId for the new user and then updating the variable
-	newUser.ID = nextId
-	nextId++
+	// Giving the new user the next id
+	usersMux.Lock()
+	if emailTaken(newUser.Email, "") {
+		usersMux.Unlock()
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "email is already in use",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+	newUser.ID = newUserID()
+	newUser.CreatedAt = time.Now()
+	newUser.UpdatedAt = newUser.CreatedAt
+	newUser.Version = 1
 	users = append(users, newUser)
+	persistUsers()
+	usersMux.Unlock()
 	// Returning
+	c.Header("Location", "/users/"+string(newUser.ID))
 	c.JSON(http.StatusCreated, Response{
 		Success: true,
 		Data:    newUser,
@@ -118,8 +329,69 @@ func createUser(c *gin.Context) {
 	})
 }
 
+// Handler for importing several users at once, each user succeeds or fails on its own
+func createUsersBatch(c *gin.Context) {
+	var items []json.RawMessage
+	// A null body decodes to a nil slice without an error
+	if err := c.ShouldBindBodyWithJSON(&items); err != nil || items == nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "request body must be a JSON array of users",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	results := make([]BatchResult, len(items))
+	created := 0
+	// Holding the lock for the whole batch so the emails are checked against the users
+	// created earlier in the same batch too
+	usersMux.Lock()
+	for i, raw := range items {
+		results[i].Index = i
+		var newUser User
+		if err := decodeStrictJSON(bytes.NewReader(raw), &newUser); err != nil {
+			results[i].Error = "invalid JSON body"
+			if field, ok := unknownField(err); ok {
+				results[i].Error = "unknown field " + strconv.Quote(field)
+			}
+			continue
+		}
+		if err := validateUser(newUser); err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if emailTaken(newUser.Email, "") {
+			results[i].Error = "email is already in use"
+			continue
+		}
+		newUser.ID = newUserID()
+		newUser.CreatedAt = time.Now()
+		newUser.UpdatedAt = newUser.CreatedAt
+		newUser.Version = 1
+		users = append(users, newUser)
+		results[i].Success = true
+		results[i].Data = &newUser
+		created++
+	}
+	if created > 0 {
+		persistUsers()
+	}
+	usersMux.Unlock()
+
+	status := http.StatusCreated
+	if created < len(items) {
+		status = http.StatusMultiStatus
+	}
+	c.JSON(status, Response{
+		Success: created == len(items),
+		Data:    results,
+		Message: strconv.Itoa(created) + " of " + strconv.Itoa(len(items)) + " users created",
+	})
+}
+
 func updateUser(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := parseUserID(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -147,8 +419,20 @@ func updateUser(c *gin.Context) {
 		})
 		return
 	}
+	// Without the version the update was based on, a concurrent change could be overwritten unnoticed
+	if updatedUser.Version < 1 {
+		c.JSON(http.StatusPreconditionRequired, Response{
+			Success: false,
+			Error:   "the version field must be the version of the user being updated",
+			Code:    http.StatusPreconditionRequired,
+		})
+		return
+	}
+
+	usersMux.Lock()
+	defer usersMux.Unlock()
 
-	user, index := findUserById(id)
+	user, _ := findUserById(id)
 	if user == nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -157,8 +441,30 @@ func updateUser(c *gin.Context) {
 		})
 		return
 	}
+	if emailTaken(updatedUser.Email, id) {
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "email is already in use",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+	if updatedUser.Version != user.Version {
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Data:    *user,
+			Error:   "user was modified, current version is " + strconv.Itoa(user.Version),
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+	// The creation time always comes from the stored user, never from the body
 	updatedUser.ID = id
-	users[index] = updatedUser
+	updatedUser.CreatedAt = user.CreatedAt
+	updatedUser.UpdatedAt = time.Now()
+	updatedUser.Version = user.Version + 1
+	*user = updatedUser
+	persistUsers()
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
@@ -167,8 +473,115 @@ func updateUser(c *gin.Context) {
 	})
 }
 
+func patchUser(c *gin.Context) {
+	id, err := parseUserID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   "invalid user ID was passed",
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	// Bodies sent as application/json-patch+json are RFC 6902 JSON Patch operations,
+	// anything else is a UserPatch with the fields to change
+	isJSONPatch := c.ContentType() == jsonPatchContentType
+	var patch UserPatch
+	var ops jsonpatch.Patch
+	if isJSONPatch {
+		body, err := io.ReadAll(c.Request.Body)
+		if err == nil {
+			ops, err = jsonpatch.DecodePatch(body)
+		}
+		if err != nil {
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   "invalid JSON Patch: " + err.Error(),
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+	} else if err := c.ShouldBindBodyWithJSON(&patch); err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	usersMux.Lock()
+	defer usersMux.Unlock()
+
+	user, _ := findUserById(id)
+	if user == nil {
+		c.JSON(http.StatusNotFound, Response{
+			Success: false,
+			Error:   "user not found",
+			Code:    http.StatusNotFound,
+		})
+		return
+	}
+
+	// Merging only the supplied fields into the stored user
+	merged := *user
+	if isJSONPatch {
+		merged, err = applyUserPatch(*user, ops)
+		if err != nil {
+			message := "failed to apply JSON Patch: " + err.Error()
+			if field, ok := unknownField(err); ok {
+				message = "JSON Patch produced an unknown field " + strconv.Quote(field)
+			}
+			c.JSON(http.StatusBadRequest, Response{
+				Success: false,
+				Error:   message,
+				Code:    http.StatusBadRequest,
+			})
+			return
+		}
+	}
+	if patch.Name != nil {
+		merged.Name = *patch.Name
+	}
+	if patch.Email != nil {
+		merged.Email = *patch.Email
+	}
+	if patch.Age != nil {
+		merged.Age = *patch.Age
+	}
+
+	if err := validateUser(merged); err != nil {
+		c.JSON(http.StatusNotAcceptable, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusNotAcceptable,
+		})
+		return
+	}
+	if emailTaken(merged.Email, id) {
+		c.JSON(http.StatusConflict, Response{
+			Success: false,
+			Error:   "email is already in use",
+			Code:    http.StatusConflict,
+		})
+		return
+	}
+
+	merged.UpdatedAt = time.Now()
+	merged.Version = user.Version + 1
+	*user = merged
+	persistUsers()
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    merged,
+		Message: "User data updated successfully",
+	})
+}
+
 func deleteUser(c *gin.Context) {
-	id, err := strconv.Atoi(c.Param("id"))
+	id, err := parseUserID(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusBadRequest, Response{
 			Success: false,
@@ -177,6 +590,9 @@ func deleteUser(c *gin.Context) {
 		})
 		return
 	}
+	usersMux.Lock()
+	defer usersMux.Unlock()
+
 	_, index := findUserById(id)
 	if index == -1 {
 		c.JSON(http.StatusNotAcceptable, Response{
@@ -188,6 +604,7 @@ func deleteUser(c *gin.Context) {
 	}
 
 	users = append(users[:index], users[index+1:]...)
+	persistUsers()
 
 	c.JSON(http.StatusOK, Response{
 		Success: true,
@@ -195,36 +612,329 @@ func deleteUser(c *gin.Context) {
 	})
 }
 
-// func searchUser(c *gin.Context) {
+// Handler for searching users by name, email and age range
+func searchUser(c *gin.Context) {
+	filter, err := parseUserFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	usersMux.RLock()
+	matched := filterUsers(users, filter)
+	usersMux.RUnlock()
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    matched,
+	})
+}
+
+// Handler for downloading the users as a CSV file, accepts the same filters as searchUser
+func exportUsers(c *gin.Context) {
+	filter, err := parseUserFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, Response{
+			Success: false,
+			Error:   err.Error(),
+			Code:    http.StatusBadRequest,
+		})
+		return
+	}
+
+	usersMux.RLock()
+	matched := filterUsers(users, filter)
+	usersMux.RUnlock()
+
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="users.csv"`)
+	c.Status(http.StatusOK)
+
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"id", "name", "email", "age"})
+	for _, user := range matched {
+		w.Write([]string{string(user.ID), user.Name, user.Email, strconv.Itoa(user.Age)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("Failed to write users CSV: %v", err)
+	}
+}
+
+// Handler for the age statistics of all users
+func getUserStats(c *gin.Context) {
+	usersMux.RLock()
+	ages := make([]int, len(users))
+	for i, user := range users {
+		ages[i] = user.Age
+	}
+	usersMux.RUnlock()
+
+	c.JSON(http.StatusOK, Response{
+		Success: true,
+		Data:    ageStats(ages),
+	})
+}
+
+// Helper function computing the statistics of ages, sorting ages in place
+func ageStats(ages []int) UserStats {
+	// Nothing to divide by, so every statistic stays zero
+	if len(ages) == 0 {
+		return UserStats{}
+	}
+
+	sort.Ints(ages)
+	total := 0
+	for _, age := range ages {
+		total += age
+	}
+	n := len(ages)
+	median := float64(ages[n/2])
+	if n%2 == 0 {
+		median = float64(ages[n/2-1]+ages[n/2]) / 2
+	}
+	return UserStats{
+		Count:     n,
+		MinAge:    ages[0],
+		MaxAge:    ages[n-1],
+		MeanAge:   float64(total) / float64(n),
+		MedianAge: median,
+	}
+}
+
+// Criteria for narrowing down the user list, zero values mean "no filter"
+type userFilter struct {
+	name   string
+	email  string
+	minAge *int
+	maxAge *int
+}
+
+// Helper function to read the user filter from the query string
+func parseUserFilter(c *gin.Context) (userFilter, error) {
+	filter := userFilter{
+		name:  strings.ToLower(c.Query("name")),
+		email: strings.ToLower(c.Query("email")),
+	}
+	if value := c.Query("min_age"); value != "" {
+		age, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, errors.New("min_age must be an integer")
+		}
+		filter.minAge = &age
+	}
+	if value := c.Query("max_age"); value != "" {
+		age, err := strconv.Atoi(value)
+		if err != nil {
+			return filter, errors.New("max_age must be an integer")
+		}
+		filter.maxAge = &age
+	}
+	return filter, nil
+}
+
+// Helper function returning a new slice with the users matching every filter
+func filterUsers(list []User, filter userFilter) []User {
+	matched := make([]User, 0, len(list))
+	for _, user := range list {
+		if filter.name != "" && !strings.Contains(strings.ToLower(user.Name), filter.name) {
+			continue
+		}
+		if filter.email != "" && !strings.Contains(strings.ToLower(user.Email), filter.email) {
+			continue
+		}
+		if filter.minAge != nil && user.Age < *filter.minAge {
+			continue
+		}
+		if filter.maxAge != nil && user.Age > *filter.maxAge {
+			continue
+		}
+		matched = append(matched, user)
+	}
+	return matched
+}
+
+// Helper function to load the users from path, seeding it with the defaults when it doesn't exist yet
+func loadUsers(path string) error {
+	usersMux.Lock()
+	defer usersMux.Unlock()
 
-// }
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return saveUsers(path)
+	}
+	if err != nil {
+		return err
+	}
 
-// Helper function to find users by ID
-func findUserById(id int) (*User, int) {
+	var loaded []User
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return err
+	}
+	users = loaded
+	// UUIDs are skipped, integer ids keep counting from the highest one
+	nextId = 1
 	for i, user := range users {
-		if user.ID == id {
-			return &user, i
+		// Users saved before versioning start at version 1
+		if user.Version < 1 {
+			users[i].Version = 1
+		}
+		if n, err := strconv.Atoi(string(user.ID)); err == nil && n >= nextId {
+			nextId = n + 1
+		}
+	}
+	return nil
+}
+
+// Helper function to write the users to path, callers must hold usersMux
+func saveUsers(path string) error {
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Writing to a temporary file first so a crash never leaves a half written file behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Helper function to save the users after a change, callers must hold usersMux
+func persistUsers() {
+	if err := saveUsers(usersFile); err != nil {
+		log.Printf("Failed to persist users: %v", err)
+	}
+}
+
+// Helper function returning the id for a new user, callers must hold usersMux
+func newUserID() UserID {
+	if useUUIDs {
+		return UserID(uuid.NewString())
+	}
+	id := UserID(strconv.Itoa(nextId))
+	nextId++
+	return id
+}
+
+// Helper function to read a user id from the URL. Integer ids and UUIDs are both accepted
+// whichever kind new users get, so users created before switching USER_IDS can still be found
+func parseUserID(param string) (UserID, error) {
+	// Ids are compared as strings, so "01" has to become "1" and UUIDs lower case
+	if n, err := strconv.Atoi(param); err == nil {
+		return UserID(strconv.Itoa(n)), nil
+	}
+	if u, err := uuid.Parse(param); err == nil {
+		return UserID(u.String()), nil
+	}
+	return "", errors.New("user id must be an integer or a UUID")
+}
+
+// Helper function to find users by ID, callers must hold usersMux. The pointer is into users,
+// so changes made through it are stored, and it is only valid until the lock is released
+func findUserById(id UserID) (*User, int) {
+	for i := range users {
+		if users[i].ID == id {
+			return &users[i], i
 		}
 	}
 	return nil, -1
 }
 
+// Helper function to check whether another user already has the email, callers must hold usersMux
+func emailTaken(email string, exceptId UserID) bool {
+	for _, user := range users {
+		if user.ID != exceptId && strings.EqualFold(user.Email, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// Helper function to decode the JSON body into obj, failing on keys obj doesn't have
+func bindStrictJSON(c *gin.Context, obj interface{}) error {
+	return decodeStrictJSON(c.Request.Body, obj)
+}
+
+// Helper function to decode JSON from r into obj, failing on keys obj doesn't have
+func decodeStrictJSON(r io.Reader, obj interface{}) error {
+	decoder := json.NewDecoder(r)
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(obj)
+}
+
+// Helper function returning the key named by an unknown field error from encoding/json,
+// which has no error type for it, only the message
+func unknownField(err error) (string, bool) {
+	rest, ok := strings.CutPrefix(err.Error(), "json: unknown field ")
+	if !ok {
+		return "", false
+	}
+	field, err := strconv.Unquote(rest)
+	return field, err == nil
+}
+
+// Helper function to read the page and limit query parameters
+func parsePagination(c *gin.Context) (int, int, error) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		return 0, 0, errors.New("page must be a positive integer")
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultUserLimit)))
+	if err != nil || limit < 1 {
+		return 0, 0, errors.New("limit must be a positive integer")
+	}
+	return page, min(limit, maxUserLimit), nil
+}
+
+// Helper function applying JSON Patch operations to the JSON form of user and decoding
+// the result again, the id, creation time and version always stay those of the stored user
+func applyUserPatch(user User, ops jsonpatch.Patch) (User, error) {
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return User{}, err
+	}
+	patched, err := ops.Apply(doc)
+	if err != nil {
+		return User{}, err
+	}
+	var result User
+	if err := decodeStrictJSON(bytes.NewReader(patched), &result); err != nil {
+		return User{}, err
+	}
+	result.ID = user.ID
+	result.CreatedAt = user.CreatedAt
+	result.Version = user.Version
+	return result, nil
+}
+
+// Helper function building a validateUser error. Handlers report its message, while
+// Meta records which field was rejected.
+func userValidationError(field string, err error) *gin.Error {
+	return &gin.Error{
+		Err:  err,
+		Type: gin.ErrorTypeBind,
+		Meta: gin.H{"field": field},
+	}
+}
+
 // Helper function for validating user input
 func validateUser(user User) error {
 	if strings.TrimSpace(user.Name) == "" {
-		return gin.Error{
-			Err:  http.ErrMissingFile,
-			Type: gin.ErrorTypeBind,
-			Meta: "name is a required field",
-		}
+		return userValidationError("name", errors.New("name is a required field"))
 	}
 
 	if strings.TrimSpace(user.Email) == "" || !strings.Contains(user.Email, "@") {
-		return gin.Error{
-			Err:  http.ErrMissingFile,
-			Type: gin.ErrorTypeBind,
-			Meta: "valid email is required",
-		}
+		return userValidationError("email", errors.New("valid email is required"))
+	}
+
+	if user.Age < 0 || user.Age > maxUserAge {
+		return userValidationError("age", fmt.Errorf("age must be between 0 and %d", maxUserAge))
 	}
 	return nil
 }
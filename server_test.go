@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// The hardcoded users, captured before any test changes them
+var seedUsers = slices.Clone(users)
+
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	gin.DefaultWriter = io.Discard
+	os.Exit(m.Run())
+}
+
+// Helper function giving a test the seed users, integer ids and its own users file
+func resetUsers(t *testing.T) {
+	t.Helper()
+	users = slices.Clone(seedUsers)
+	nextId = len(seedUsers) + 1
+	useUUIDs = false
+	usersFile = filepath.Join(t.TempDir(), "users.json")
+}
+
+// Helper function sending a JSON request through the user routes
+func performRequest(router http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, path, reader)
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// Helper function decoding the Response envelope, unmarshalling its data into data when it isn't nil
+func decodeResponse(t *testing.T, w *httptest.ResponseRecorder, data interface{}) Response {
+	t.Helper()
+	resp := Response{Data: data}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding response %q: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestConcurrentCreateUser(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	const count = 50
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := `{"name":"User ` + strconv.Itoa(i) + `","email":"user` + strconv.Itoa(i) + `@example.com","age":20}`
+			if w := performRequest(router, http.MethodPost, "/users", body); w.Code != http.StatusCreated {
+				t.Errorf("create %d: status = %d: %s", i, w.Code, w.Body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(users) != len(seedUsers)+count {
+		t.Fatalf("got %d users, want %d", len(users), len(seedUsers)+count)
+	}
+	seen := make(map[UserID]bool, len(users))
+	for _, user := range users {
+		if seen[user.ID] {
+			t.Fatalf("id %s was given out twice", user.ID)
+		}
+		seen[user.ID] = true
+	}
+}
+
+func TestUserIDJSON(t *testing.T) {
+	tests := []struct {
+		name string
+		id   UserID
+		want string
+	}{
+		{"integer id", "7", `"id":7`},
+		{"uuid", "0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11", `"id":"0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11"`},
+		// Parseable as integers, but not in the form JSON numbers take
+		{"plus sign", "+5", `"id":"+5"`},
+		{"leading zeros", "007", `"id":"007"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := json.Marshal(User{ID: tt.id, Name: "n", Email: "e@example.com"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(data), tt.want) || strings.Contains(string(data), `"int"`) {
+				t.Fatalf("got %s, want it to contain %s", data, tt.want)
+			}
+
+			var decoded User
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			if decoded.ID != tt.id {
+				t.Fatalf("id after round trip = %q, want %q", decoded.ID, tt.id)
+			}
+		})
+	}
+}
+
+func TestCreateUserReturnsID(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	w := performRequest(router, http.MethodPost, "/users", `{"name":"New","email":"new@example.com","age":40}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+	var body struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Data["id"] != float64(len(seedUsers)+1) {
+		t.Fatalf("id = %v, want %d", body.Data["id"], len(seedUsers)+1)
+	}
+}
+
+func TestEmailUniqueness(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"create with taken email", http.MethodPost, "/users", `{"name":"Copy","email":"john.doe@gmail.com","age":20}`, http.StatusConflict},
+		{"create with taken email in other case", http.MethodPost, "/users", `{"name":"Copy","email":"John.Doe@Gmail.com","age":20}`, http.StatusConflict},
+		{"create with free email", http.MethodPost, "/users", `{"name":"New","email":"new@example.com","age":20}`, http.StatusCreated},
+		{"update to another user's email", http.MethodPut, "/users/2", `{"name":"Jane","email":"JOHN.DOE@gmail.com","age":31,"version":1}`, http.StatusConflict},
+		{"update keeping own email", http.MethodPut, "/users/1", `{"name":"John","email":"john.doe@gmail.com","age":31,"version":1}`, http.StatusOK},
+		{"patch to another user's email", http.MethodPatch, "/users/2", `{"email":"max.williams@gmail.com"}`, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+			router := setupRouter()
+
+			w := performRequest(router, tt.method, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus == http.StatusConflict {
+				if resp := decodeResponse(t, w, nil); resp.Error != "email is already in use" {
+					t.Fatalf("error = %q", resp.Error)
+				}
+			}
+		})
+	}
+}
+
+// Helper function replacing the users for a test that needs particular ones
+func setUsers(t *testing.T, list ...User) {
+	t.Helper()
+	resetUsers(t)
+	users = list
+	nextId = len(list) + 1
+}
+
+// Helper function listing the ids of users in order
+func userIDs(list []User) []UserID {
+	ids := make([]UserID, len(list))
+	for i, user := range list {
+		ids[i] = user.ID
+	}
+	return ids
+}
+
+var searchTestUsers = []User{
+	{ID: "1", Name: "John Doe", Email: "john.doe@gmail.com", Age: 30, Version: 1},
+	{ID: "2", Name: "Jane Smith", Email: "jane@corp.io", Age: 25, Version: 1},
+	{ID: "3", Name: "Johnny Cash", Email: "cash@gmail.com", Age: 60, Version: 1},
+}
+
+func TestSearchUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []UserID
+	}{
+		{"name", "name=JOHN", http.StatusOK, []UserID{"1", "3"}},
+		{"email", "email=gmail", http.StatusOK, []UserID{"1", "3"}},
+		{"min age", "min_age=30", http.StatusOK, []UserID{"1", "3"}},
+		{"max age", "max_age=29", http.StatusOK, []UserID{"2"}},
+		{"combined", "name=john&max_age=40", http.StatusOK, []UserID{"1"}},
+		{"no match", "name=nobody", http.StatusOK, []UserID{}},
+		{"bad min age", "min_age=abc", http.StatusBadRequest, nil},
+		{"bad max age", "max_age=1.5", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUsers(t, slices.Clone(searchTestUsers)...)
+			router := setupRouter()
+
+			w := performRequest(router, http.MethodGet, "/users/search?"+tt.query, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var found []User
+			decodeResponse(t, w, &found)
+			if got := userIDs(found); !slices.Equal(got, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", got, tt.wantIDs)
+			}
+		})
+	}
+}
+
+// Helper function building count users with ids 1 to count
+func numberedUsers(count int) []User {
+	list := make([]User, count)
+	for i := range list {
+		n := strconv.Itoa(i + 1)
+		list[i] = User{ID: UserID(n), Name: "User " + n, Email: "user" + n + "@example.com", Age: 20 + i, Version: 1}
+	}
+	return list
+}
+
+func TestGetAllUsersPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []UserID
+		wantMeta   PageMeta
+	}{
+		{"defaults", "", http.StatusOK, userIDs(numberedUsers(5)), PageMeta{Total: 5, Page: 1, TotalPages: 1, Limit: defaultUserLimit}},
+		{"first page", "?page=1&limit=2", http.StatusOK, []UserID{"1", "2"}, PageMeta{Total: 5, Page: 1, TotalPages: 3, Limit: 2}},
+		{"middle page", "?page=2&limit=2", http.StatusOK, []UserID{"3", "4"}, PageMeta{Total: 5, Page: 2, TotalPages: 3, Limit: 2}},
+		{"last page", "?page=3&limit=2", http.StatusOK, []UserID{"5"}, PageMeta{Total: 5, Page: 3, TotalPages: 3, Limit: 2}},
+		{"out of range page", "?page=9&limit=2", http.StatusOK, []UserID{}, PageMeta{Total: 5, Page: 9, TotalPages: 3, Limit: 2}},
+		{"limit is clamped", "?limit=100000", http.StatusOK, userIDs(numberedUsers(5)), PageMeta{Total: 5, Page: 1, TotalPages: 1, Limit: maxUserLimit}},
+		{"zero page", "?page=0", http.StatusBadRequest, nil, PageMeta{}},
+		{"non numeric limit", "?limit=ten", http.StatusBadRequest, nil, PageMeta{}},
+		{"negative limit", "?limit=-1", http.StatusBadRequest, nil, PageMeta{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUsers(t, numberedUsers(5)...)
+			router := setupRouter()
+
+			w := performRequest(router, http.MethodGet, "/users"+tt.query, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list []User
+			var meta PageMeta
+			resp := Response{Data: &list, Meta: &meta}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if list == nil {
+				t.Fatalf("data is null, want an array: %s", w.Body)
+			}
+			if got := userIDs(list); !slices.Equal(got, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", got, tt.wantIDs)
+			}
+			if meta != tt.wantMeta {
+				t.Fatalf("meta = %+v, want %+v", meta, tt.wantMeta)
+			}
+		})
+	}
+}
+
+func TestValidateUserAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		age     int
+		wantErr bool
+	}{
+		{"negative", -1, true},
+		{"zero", 0, false},
+		{"upper bound", maxUserAge, false},
+		{"too high", maxUserAge + 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUser(User{Name: "Ann", Email: "ann@example.com", Age: tt.age})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("validateUser(age %d) = %v, want error %v", tt.age, err, tt.wantErr)
+			}
+			if err != nil {
+				var ginErr *gin.Error
+				if !errors.As(err, &ginErr) || ginErr.Type != gin.ErrorTypeBind || !maps.Equal(ginErr.Meta.(gin.H), gin.H{"field": "age"}) {
+					t.Fatalf("error = %#v, want a bind *gin.Error for the age field", err)
+				}
+				if want := fmt.Sprintf("age must be between 0 and %d", maxUserAge); err.Error() != want {
+					t.Fatalf("error = %q, want %q", err, want)
+				}
+			}
+
+			resetUsers(t)
+			w := performRequest(setupRouter(), http.MethodPost, "/users", `{"name":"Ann","email":"ann@example.com","age":`+strconv.Itoa(tt.age)+`}`)
+			if wantCreated := !tt.wantErr; (w.Code == http.StatusCreated) != wantCreated {
+				t.Fatalf("create status = %d, want created %v: %s", w.Code, wantCreated, w.Body)
+			}
+		})
+	}
+}
+
+func TestUsersSurviveRestart(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	w := performRequest(router, http.MethodPost, "/users", `{"name":"Kept","email":"kept@example.com","age":33}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var created User
+	decodeResponse(t, w, &created)
+
+	// Restarting drops everything held in memory before loading the file again
+	users = nil
+	nextId = 1
+	if err := loadUsers(usersFile); err != nil {
+		t.Fatal(err)
+	}
+
+	user, _ := findUserById(created.ID)
+	if user == nil || user.Email != "kept@example.com" {
+		t.Fatalf("user %s did not survive the restart: %+v", created.ID, users)
+	}
+	if len(users) != len(seedUsers)+1 {
+		t.Fatalf("got %d users after the restart, want %d", len(users), len(seedUsers)+1)
+	}
+	if nextId != len(seedUsers)+2 {
+		t.Fatalf("nextId = %d, want %d", nextId, len(seedUsers)+2)
+	}
+}
+
+func TestLoadUsersSeedsMissingFile(t *testing.T) {
+	resetUsers(t)
+
+	if err := loadUsers(usersFile); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(usersFile)
+	if err != nil {
+		t.Fatalf("the seed users were not written: %v", err)
+	}
+	var saved []User
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := userIDs(saved), userIDs(seedUsers); !slices.Equal(got, want) {
+		t.Fatalf("saved ids = %v, want %v", got, want)
+	}
+}
+
+func TestExportUsers(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		want  [][]string
+	}{
+		{"all users", "", [][]string{
+			{"id", "name", "email", "age"},
+			{"1", "John Doe", "john.doe@gmail.com", "30"},
+			{"2", "Jane Smith", "jane@corp.io", "25"},
+			{"3", "Johnny Cash", "cash@gmail.com", "60"},
+		}},
+		{"filtered", "?email=gmail&min_age=40", [][]string{
+			{"id", "name", "email", "age"},
+			{"3", "Johnny Cash", "cash@gmail.com", "60"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUsers(t, slices.Clone(searchTestUsers)...)
+
+			w := performRequest(setupRouter(), http.MethodGet, "/users/export"+tt.query, "")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", w.Code, w.Body)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, "text/csv") {
+				t.Fatalf("Content-Type = %q", got)
+			}
+			if got := w.Header().Get("Content-Disposition"); got != `attachment; filename="users.csv"` {
+				t.Fatalf("Content-Disposition = %q", got)
+			}
+			rows, err := csv.NewReader(w.Body).ReadAll()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(rows, tt.want, slices.Equal) {
+				t.Fatalf("rows = %q, want %q", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestExportUsersRejectsBadFilter(t *testing.T) {
+	resetUsers(t)
+
+	w := performRequest(setupRouter(), http.MethodGet, "/users/export?max_age=old", "")
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPatchUser(t *testing.T) {
+	john := seedUsers[0]
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		want       User
+	}{
+		{"email only", "/users/1", `{"email":"john@example.com"}`, http.StatusOK, User{Name: john.Name, Email: "john@example.com", Age: john.Age}},
+		{"name only", "/users/1", `{"name":"Johnny"}`, http.StatusOK, User{Name: "Johnny", Email: john.Email, Age: john.Age}},
+		{"zero age is applied", "/users/1", `{"age":0}`, http.StatusOK, User{Name: john.Name, Email: john.Email, Age: 0}},
+		{"empty patch", "/users/1", `{}`, http.StatusOK, User{Name: john.Name, Email: john.Email, Age: john.Age}},
+		{"blank name fails validation", "/users/1", `{"name":" "}`, http.StatusNotAcceptable, User{}},
+		{"bad age fails validation", "/users/1", `{"age":-5}`, http.StatusNotAcceptable, User{}},
+		{"unknown user", "/users/99", `{"name":"Nobody"}`, http.StatusNotFound, User{}},
+		{"bad id", "/users/abc", `{"name":"Nobody"}`, http.StatusBadRequest, User{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+
+			w := performRequest(setupRouter(), http.MethodPatch, tt.path, tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			stored, _ := findUserById(john.ID)
+			if tt.wantStatus != http.StatusOK {
+				if stored.Name != john.Name || stored.Email != john.Email || stored.Age != john.Age || stored.Version != john.Version {
+					t.Fatalf("a failed patch changed the user: %+v", *stored)
+				}
+				return
+			}
+
+			var patched User
+			decodeResponse(t, w, &patched)
+			for _, got := range []User{patched, *stored} {
+				if got.Name != tt.want.Name || got.Email != tt.want.Email || got.Age != tt.want.Age {
+					t.Fatalf("user = %+v, want name %q, email %q, age %d", got, tt.want.Name, tt.want.Email, tt.want.Age)
+				}
+				if got.Version != john.Version+1 {
+					t.Fatalf("version = %d, want %d", got.Version, john.Version+1)
+				}
+			}
+		})
+	}
+}
+
+func TestGetAllUsersFilterAndSort(t *testing.T) {
+	tests := []struct {
+		name       string
+		query      string
+		wantStatus int
+		wantIDs    []UserID
+	}{
+		{"sort by name", "sort=name", http.StatusOK, []UserID{"2", "1", "3"}},
+		{"sort by name descending", "sort=-name", http.StatusOK, []UserID{"3", "1", "2"}},
+		{"sort by age", "sort=age", http.StatusOK, []UserID{"2", "1", "3"}},
+		{"sort by age descending", "sort=-age", http.StatusOK, []UserID{"3", "1", "2"}},
+		{"age range", "min_age=26&max_age=60", http.StatusOK, []UserID{"1", "3"}},
+		{"age range sorted and paged", "min_age=26&sort=-age&limit=1", http.StatusOK, []UserID{"3"}},
+		{"unknown sort", "sort=email", http.StatusBadRequest, nil},
+		{"non numeric min age", "min_age=young", http.StatusBadRequest, nil},
+		{"non numeric max age", "max_age=1e2", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUsers(t, slices.Clone(searchTestUsers)...)
+
+			w := performRequest(setupRouter(), http.MethodGet, "/users?"+tt.query, "")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				return
+			}
+			var list []User
+			decodeResponse(t, w, &list)
+			if got := userIDs(list); !slices.Equal(got, tt.wantIDs) {
+				t.Fatalf("ids = %v, want %v", got, tt.wantIDs)
+			}
+			// Sorting works on a copy, the stored order stays the same
+			if got := userIDs(users); !slices.Equal(got, userIDs(searchTestUsers)) {
+				t.Fatalf("stored ids = %v, want %v", got, userIDs(searchTestUsers))
+			}
+		})
+	}
+}
+
+func TestUserTimestamps(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	before := time.Now()
+	w := performRequest(router, http.MethodPost, "/users", `{"name":"Timed","email":"timed@example.com","age":30}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create status = %d: %s", w.Code, w.Body)
+	}
+	var created User
+	decodeResponse(t, w, &created)
+	if created.CreatedAt.Before(before) || !created.UpdatedAt.Equal(created.CreatedAt) {
+		t.Fatalf("created_at = %v, updated_at = %v, want both set to the creation time", created.CreatedAt, created.UpdatedAt)
+	}
+
+	path := "/users/" + string(created.ID)
+	last := created
+	updates := []struct {
+		method string
+		body   string
+	}{
+		{http.MethodPut, `{"name":"Timed","email":"timed@example.com","age":31,"version":1}`},
+		{http.MethodPatch, `{"age":32}`},
+	}
+	for _, update := range updates {
+		time.Sleep(time.Millisecond)
+		w := performRequest(router, update.method, path, update.body)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status = %d: %s", update.method, w.Code, w.Body)
+		}
+		var updated User
+		decodeResponse(t, w, &updated)
+		if !updated.CreatedAt.Equal(created.CreatedAt) {
+			t.Fatalf("%s changed created_at from %v to %v", update.method, created.CreatedAt, updated.CreatedAt)
+		}
+		if !updated.UpdatedAt.After(last.UpdatedAt) {
+			t.Fatalf("%s left updated_at at %v, want it after %v", update.method, updated.UpdatedAt, last.UpdatedAt)
+		}
+		last = updated
+	}
+
+	// The JSON output carries both fields
+	w = performRequest(router, http.MethodGet, path, "")
+	for _, field := range []string{`"created_at":`, `"updated_at":`} {
+		if !strings.Contains(w.Body.String(), field) {
+			t.Fatalf("response %s is missing %s", w.Body, field)
+		}
+	}
+}
+
+func TestCreateUserLocation(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	w := performRequest(router, http.MethodPost, "/users", `{"name":"Located","email":"located@example.com","age":30}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("status = %d: %s", w.Code, w.Body)
+	}
+	var created User
+	decodeResponse(t, w, &created)
+	location := w.Header().Get("Location")
+	if want := "/users/" + string(created.ID); location != want {
+		t.Fatalf("Location = %q, want %q", location, want)
+	}
+
+	var fetched User
+	w = performRequest(router, http.MethodGet, location, "")
+	decodeResponse(t, w, &fetched)
+	if w.Code != http.StatusOK || fetched.Email != "located@example.com" {
+		t.Fatalf("GET %s: status %d, user %+v", location, w.Code, fetched)
+	}
+}
+
+func TestCreateUserRejectsUnknownFields(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+		wantError  string
+	}{
+		{"known fields", `{"name":"Ann","email":"ann@example.com","age":30}`, http.StatusCreated, ""},
+		{"typo", `{"name":"Ann","emial":"ann@example.com","age":30}`, http.StatusBadRequest, `unknown field "emial"`},
+		{"unknown extra field", `{"name":"Ann","email":"ann@example.com","age":30,"admin":true}`, http.StatusBadRequest, `unknown field "admin"`},
+		{"malformed", `{"name":`, http.StatusBadRequest, "invalid JSON body"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+
+			w := performRequest(setupRouter(), http.MethodPost, "/users", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if tt.wantError == "" {
+				return
+			}
+			if resp := decodeResponse(t, w, nil); resp.Error != tt.wantError {
+				t.Fatalf("error = %q, want %q", resp.Error, tt.wantError)
+			}
+			if len(users) != len(seedUsers) {
+				t.Fatalf("%d users, want %d", len(users), len(seedUsers))
+			}
+		})
+	}
+}
+
+func TestCreateUsersBatch(t *testing.T) {
+	type result struct {
+		success bool
+		id      UserID
+		err     string
+	}
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantResults []result
+	}{
+		{"all valid", `[{"name":"Ann","email":"ann@example.com","age":30},{"name":"Bob","email":"bob@example.com","age":40}]`,
+			http.StatusCreated, []result{{true, "4", ""}, {true, "5", ""}}},
+		{"duplicates and valid entries", `[
+			{"name":"Ann","email":"ann@example.com","age":30},
+			{"name":"Ann again","email":"ANN@example.com","age":31},
+			{"name":"Copy","email":"john.doe@gmail.com","age":20},
+			{"name":"","email":"nameless@example.com","age":20},
+			{"name":"Typo","emial":"typo@example.com","age":20},
+			{"name":"Bob","email":"bob@example.com","age":40}
+		]`, http.StatusMultiStatus, []result{
+			{true, "4", ""},
+			{false, "", "email is already in use"},
+			{false, "", "email is already in use"},
+			{false, "", "name is a required field"},
+			{false, "", `unknown field "emial"`},
+			{true, "5", ""},
+		}},
+		{"empty", `[]`, http.StatusCreated, []result{}},
+		{"not an array", `{"name":"Ann","email":"ann@example.com","age":30}`, http.StatusBadRequest, nil},
+		{"malformed", `[{"name":`, http.StatusBadRequest, nil},
+		{"null", `null`, http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+
+			w := performRequest(setupRouter(), http.MethodPost, "/users/batch", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			created := 0
+			if tt.wantResults != nil {
+				var results []BatchResult
+				decodeResponse(t, w, &results)
+				if len(results) != len(tt.wantResults) {
+					t.Fatalf("got %d results, want %d", len(results), len(tt.wantResults))
+				}
+				for i, res := range results {
+					want := tt.wantResults[i]
+					var id UserID
+					if res.Data != nil {
+						id = res.Data.ID
+					}
+					if res.Index != i || res.Success != want.success || id != want.id || res.Error != want.err {
+						t.Errorf("result %d = %+v, want %+v", i, res, want)
+					}
+					if res.Success {
+						created++
+					}
+				}
+			} else if resp := decodeResponse(t, w, nil); resp.Error != "request body must be a JSON array of users" {
+				t.Fatalf("error = %q", resp.Error)
+			}
+
+			if len(users) != len(seedUsers)+created {
+				t.Fatalf("%d users, want %d", len(users), len(seedUsers)+created)
+			}
+		})
+	}
+}
+
+func TestPatchUserJSONPatch(t *testing.T) {
+	john := seedUsers[0]
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantError  string
+		want       User
+	}{
+		{"replace", "/users/1", `[{"op":"replace","path":"/name","value":"Johnny"}]`, http.StatusOK, "",
+			User{Name: "Johnny", Email: john.Email, Age: john.Age}},
+		{"remove", "/users/1", `[{"op":"remove","path":"/age"}]`, http.StatusOK, "",
+			User{Name: john.Name, Email: john.Email, Age: 0}},
+		{"test then replace", "/users/1", `[{"op":"test","path":"/email","value":"john.doe@gmail.com"},{"op":"replace","path":"/email","value":"john@example.com"}]`, http.StatusOK, "",
+			User{Name: john.Name, Email: "john@example.com", Age: john.Age}},
+		// The id, creation time and version stay the server's
+		{"replace id", "/users/1", `[{"op":"replace","path":"/id","value":"9"},{"op":"replace","path":"/version","value":7}]`, http.StatusOK, "",
+			User{Name: john.Name, Email: john.Email, Age: john.Age}},
+		{"remove required field", "/users/1", `[{"op":"remove","path":"/name"}]`, http.StatusNotAcceptable, "name is a required field", User{}},
+		{"failed test", "/users/1", `[{"op":"test","path":"/name","value":"Someone"},{"op":"replace","path":"/name","value":"Johnny"}]`, http.StatusBadRequest, "", User{}},
+		{"unknown field", "/users/1", `[{"op":"add","path":"/nickname","value":"JD"}]`, http.StatusBadRequest, `JSON Patch produced an unknown field "nickname"`, User{}},
+		{"taken email", "/users/1", `[{"op":"replace","path":"/email","value":"jane.smith@gmail.com"}]`, http.StatusConflict, "email is already in use", User{}},
+		{"not a patch", "/users/1", `{"name":"Johnny"}`, http.StatusBadRequest, "", User{}},
+		{"unknown user", "/users/99", `[{"op":"replace","path":"/name","value":"Nobody"}]`, http.StatusNotFound, "user not found", User{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+
+			req := httptest.NewRequest(http.MethodPatch, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json-patch+json")
+			w := httptest.NewRecorder()
+			setupRouter().ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			stored, _ := findUserById(john.ID)
+			if tt.wantStatus != http.StatusOK {
+				resp := decodeResponse(t, w, nil)
+				if tt.wantError != "" && resp.Error != tt.wantError {
+					t.Fatalf("error = %q, want %q", resp.Error, tt.wantError)
+				}
+				if stored.Name != john.Name || stored.Email != john.Email || stored.Age != john.Age || stored.Version != john.Version {
+					t.Fatalf("a failed patch changed the user: %+v", *stored)
+				}
+				return
+			}
+
+			var patched User
+			decodeResponse(t, w, &patched)
+			for _, got := range []User{patched, *stored} {
+				if got.ID != john.ID || got.Name != tt.want.Name || got.Email != tt.want.Email || got.Age != tt.want.Age {
+					t.Fatalf("user = %+v, want name %q, email %q, age %d", got, tt.want.Name, tt.want.Email, tt.want.Age)
+				}
+				if got.Version != john.Version+1 || !got.CreatedAt.Equal(john.CreatedAt) {
+					t.Fatalf("version %d, created %v; want %d, %v", got.Version, got.CreatedAt, john.Version+1, john.CreatedAt)
+				}
+			}
+		})
+	}
+}
+
+func TestParseUserID(t *testing.T) {
+	tests := []struct {
+		param   string
+		want    UserID
+		wantErr bool
+	}{
+		{"7", "7", false},
+		{"007", "7", false},
+		{"0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11", "0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11", false},
+		{"0B7F2A36-5F4E-4C8E-9A57-2F1D0F3C9E11", "0b7f2a36-5f4e-4c8e-9a57-2f1d0f3c9e11", false},
+		{"abc", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.param, func(t *testing.T) {
+			got, err := parseUserID(tt.param)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Fatalf("parseUserID(%q) = %q, %v; want %q, error %v", tt.param, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUUIDUsers(t *testing.T) {
+	resetUsers(t)
+	useUUIDs = true
+	router := setupRouter()
+
+	w := performRequest(router, http.MethodPost, "/users", `{"name":"Ann","email":"ann@example.com","age":30}`)
+	var created User
+	decodeResponse(t, w, &created)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	parsed, err := uuid.Parse(string(created.ID))
+	if err != nil || parsed.String() != string(created.ID) {
+		t.Fatalf("id %q is not a lower case UUID", created.ID)
+	}
+	// UUIDs don't use up the integer sequence
+	if nextId != len(seedUsers)+1 {
+		t.Fatalf("nextId = %d, want %d", nextId, len(seedUsers)+1)
+	}
+	path := "/users/" + string(created.ID)
+
+	steps := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+	}{
+		{"get", http.MethodGet, path, "", http.StatusOK},
+		{"get in upper case", http.MethodGet, "/users/" + strings.ToUpper(string(created.ID)), "", http.StatusOK},
+		{"update", http.MethodPut, path, `{"name":"Ann B","email":"ann@example.com","age":31,"version":1}`, http.StatusOK},
+		{"patch", http.MethodPatch, path, `{"age":32}`, http.StatusOK},
+		// Users created with integer ids can still be found
+		{"integer user", http.MethodGet, "/users/1", "", http.StatusOK},
+		{"delete", http.MethodDelete, path, "", http.StatusOK},
+		{"get deleted", http.MethodGet, path, "", http.StatusNotFound},
+	}
+	for _, step := range steps {
+		w := performRequest(router, step.method, step.path, step.body)
+		if w.Code != step.wantStatus {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, w.Code, step.wantStatus, w.Body)
+		}
+		if step.wantStatus != http.StatusOK || step.method == http.MethodDelete || step.path != path {
+			continue
+		}
+		var user User
+		decodeResponse(t, w, &user)
+		if user.ID != created.ID {
+			t.Fatalf("%s: id %q, want %q", step.name, user.ID, created.ID)
+		}
+	}
+}
+
+func TestAgeStats(t *testing.T) {
+	tests := []struct {
+		name string
+		ages []int
+		want UserStats
+	}{
+		{"empty", nil, UserStats{}},
+		{"one user", []int{42}, UserStats{Count: 1, MinAge: 42, MaxAge: 42, MeanAge: 42, MedianAge: 42}},
+		{"odd count", []int{60, 20, 31}, UserStats{Count: 3, MinAge: 20, MaxAge: 60, MeanAge: 37, MedianAge: 31}},
+		{"even count", []int{40, 20, 30, 25}, UserStats{Count: 4, MinAge: 20, MaxAge: 40, MeanAge: 28.75, MedianAge: 27.5}},
+		{"newborns", []int{0, 0}, UserStats{Count: 2, MinAge: 0, MaxAge: 0, MeanAge: 0, MedianAge: 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ageStats(tt.ages); got != tt.want {
+				t.Fatalf("ageStats(%v) = %+v, want %+v", tt.ages, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetUserStats(t *testing.T) {
+	tests := []struct {
+		name  string
+		users []User
+		want  UserStats
+	}{
+		{"search users", searchTestUsers, UserStats{Count: 3, MinAge: 25, MaxAge: 60, MeanAge: 115.0 / 3, MedianAge: 30}},
+		{"no users", []User{}, UserStats{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setUsers(t, slices.Clone(tt.users)...)
+
+			w := performRequest(setupRouter(), http.MethodGet, "/users/stats", "")
+			var stats UserStats
+			decodeResponse(t, w, &stats)
+			if w.Code != http.StatusOK || stats != tt.want {
+				t.Fatalf("status %d, stats %+v; want %+v", w.Code, stats, tt.want)
+			}
+			// Sorting the ages must not reorder the users
+			if !slices.Equal(userIDs(users), userIDs(tt.users)) {
+				t.Fatalf("users reordered to %v", userIDs(users))
+			}
+		})
+	}
+}
+
+func TestUpdateUserVersioning(t *testing.T) {
+	update := func(version string) string {
+		return `{"name":"John","email":"john.doe@gmail.com","age":31` + version + `}`
+	}
+	tests := []struct {
+		name        string
+		body        string
+		wantStatus  int
+		wantVersion int
+	}{
+		{"current version", update(`,"version":1`), http.StatusOK, 2},
+		{"stale version", update(`,"version":2`), http.StatusConflict, 1},
+		{"no version", update(""), http.StatusPreconditionRequired, 1},
+		{"zero version", update(`,"version":0`), http.StatusPreconditionRequired, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetUsers(t)
+
+			w := performRequest(setupRouter(), http.MethodPut, "/users/1", tt.body)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			// A conflict hands back the current user so the client can retry on top of it
+			var user User
+			resp := decodeResponse(t, w, &user)
+			if tt.wantStatus == http.StatusConflict && (user.Version != 1 || resp.Error != "user was modified, current version is 1") {
+				t.Fatalf("conflict response %+v, user %+v", resp, user)
+			}
+			if stored, _ := findUserById("1"); stored.Version != tt.wantVersion {
+				t.Fatalf("stored version = %d, want %d", stored.Version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestUpdateUserLostUpdate(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	// Both clients read version 1, only the first write may land
+	first := performRequest(router, http.MethodPut, "/users/1", `{"name":"First","email":"john.doe@gmail.com","age":31,"version":1}`)
+	second := performRequest(router, http.MethodPut, "/users/1", `{"name":"Second","email":"john.doe@gmail.com","age":32,"version":1}`)
+	if first.Code != http.StatusOK || second.Code != http.StatusConflict {
+		t.Fatalf("statuses %d and %d, want %d and %d", first.Code, second.Code, http.StatusOK, http.StatusConflict)
+	}
+	retry := performRequest(router, http.MethodPut, "/users/1", `{"name":"Second","email":"john.doe@gmail.com","age":32,"version":2}`)
+	var user User
+	decodeResponse(t, retry, &user)
+	if retry.Code != http.StatusOK || user.Name != "Second" || user.Version != 3 {
+		t.Fatalf("retry: status %d, user %+v", retry.Code, user)
+	}
+}
+
+func TestUpdateUserConcurrent(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	succeeded := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := `{"name":"Writer ` + strconv.Itoa(i) + `","email":"john.doe@gmail.com","age":31,"version":1}`
+			if performRequest(router, http.MethodPut, "/users/1", body).Code == http.StatusOK {
+				mu.Lock()
+				succeeded++
+				mu.Unlock()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Fatalf("%d updates succeeded, want 1", succeeded)
+	}
+	if stored, _ := findUserById("1"); stored.Version != 2 {
+		t.Fatalf("stored version = %d, want 2", stored.Version)
+	}
+}
+
+func TestFindUserByIdPointsIntoUsers(t *testing.T) {
+	resetUsers(t)
+	router := setupRouter()
+
+	usersMux.Lock()
+	user, index := findUserById("2")
+	if user == nil || index != 1 {
+		usersMux.Unlock()
+		t.Fatalf("findUserById(2) = %v, %d", user, index)
+	}
+	user.Name = "Changed through the pointer"
+	usersMux.Unlock()
+
+	w := performRequest(router, http.MethodGet, "/users?limit=100", "")
+	var list []User
+	decodeResponse(t, w, &list)
+	i := slices.IndexFunc(list, func(u User) bool { return u.ID == "2" })
+	if w.Code != http.StatusOK || i == -1 || list[i].Name != "Changed through the pointer" {
+		t.Fatalf("status %d, users %+v", w.Code, list)
+	}
+
+	if user, index := findUserById("99"); user != nil || index != -1 {
+		t.Fatalf("findUserById(99) = %v, %d; want nil, -1", user, index)
+	}
+}